@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
 const CniCommandVar = "CNI_COMMAND"
@@ -61,3 +62,21 @@ func LoadCniEnvironmentValues() (*CniArgs, *ErrorResult) {
 
 	return &cniRequest, nil
 }
+
+// ParseExtraArgs splits CNI_ARGS (e.g. "IgnoreUnknown=1;K8S_POD_NAME=foo;IP=10.244.1.5") into a key/value map
+func (cniArgs *CniArgs) ParseExtraArgs() (map[string]string, error) {
+	extraArgs := make(map[string]string)
+	if cniArgs.ExtraArgs == "" {
+		return extraArgs, nil
+	}
+
+	for _, pair := range strings.Split(cniArgs.ExtraArgs, ";") {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("invalid CNI_ARGS pair [%s]", pair)
+		}
+		extraArgs[keyValue[0]] = keyValue[1]
+	}
+
+	return extraArgs, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExtraArgs(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		extraArgs string
+		expected  map[string]string
+		err       bool
+	}{
+		{name: "empty", extraArgs: "", expected: map[string]string{}},
+		{name: "kubelet args", extraArgs: "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0;IP=10.244.1.5", expected: map[string]string{
+			"IgnoreUnknown": "1", "K8S_POD_NAMESPACE": "default", "K8S_POD_NAME": "web-0", "IP": "10.244.1.5",
+		}},
+		{name: "value holding an equal sign", extraArgs: "A=b=c", expected: map[string]string{"A": "b=c"}},
+		{name: "empty value", extraArgs: "IP=", expected: map[string]string{"IP": ""}},
+		{name: "pair without value", extraArgs: "IgnoreUnknown=1;K8S_POD_NAME", err: true},
+		{name: "trailing separator", extraArgs: "IgnoreUnknown=1;", err: true},
+	} {
+		extraArgs, err := (&CniArgs{ExtraArgs: test.extraArgs}).ParseExtraArgs()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, extraArgs)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(extraArgs, test.expected) {
+			t.Errorf("%s: expected %v, got %v (%v)", test.name, test.expected, extraArgs, err)
+		}
+	}
+}
@@ -1,19 +1,38 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 	"yarp-cni/pkg/cni"
 	"yarp-cni/pkg/im"
 	"yarp-cni/pkg/ipam"
+	"yarp-cni/pkg/kube"
 	"yarp-cni/pkg/router"
 
 	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
 )
 
 const CniVersion = "0.3.1"
 
+const DefaultNetworkName = "yarp"
+const DefaultBridgeName = "yarp0"
+const DefaultIpamDbPath = "/etc/cni/ipam.db"
+
+const LocalIpamType = "local"
+const CrdIpamType = "crd"
+const EtcdIpamType = "etcd"
+
+// StateDir holds one directory per network with what each attachment set up
+const StateDir = "/var/lib/cni/yarp"
+
 type PluginMode string
 
 const CniPluginMode = "CNI"
@@ -24,21 +43,72 @@ func main() {
 	logger := SetupLogging(pluginMode)
 
 	if pluginMode == RouterPluginMode {
-		//start router controller
-		router.NewRouteController(logger, "master")
-	} else {
-		// Eventually load settings
-		interfaceSettings := im.InterfaceConfiguration{BridgeName: "yarp0"}
-		ipamSettings := &ipam.LocalIpamClientConfig{IpamDbPath: "/etc/cni/ipam.db"}
-		dnSettings := cni.Dns{
-			Nameservers: []string{"10.96.0.10"},
-			Domain:      "",
-			Search:      []string{"svc.cluster.local", "cluster.local", "local"},
+		nodeName, err := kube.NodeName("")
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+
+		clientset, err := router.NewClientset()
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+
+		routeController, err := newRouteController(logger, clientset, nodeName)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
 		}
 
-		ipamClient := ipam.NewLocalIpamClient(logger, ipamSettings)
-		interfaceClient := im.NewInterfaceManager(logger, interfaceSettings, ipamClient)
+		// The blocks of the etcd ipam are routed along with those of the ConfigMap,
+		// and those of the node live as long as the router renews their lease
+		etcdEndpoints, hasEtcd := os.LookupEnv("ETCD_ENDPOINTS")
+		if hasEtcd {
+			etcdIpamClient, err := newRouterEtcdIpamClient(logger, nodeName, strings.Split(etcdEndpoints, ","))
+			if err != nil {
+				logger.Error(err)
+				os.Exit(1)
+			}
 
+			routeController.BlockSources = append(routeController.BlockSources, etcdIpamClient)
+			if etcdIpamClient.Config.LeaseTtl > 0 {
+				go keepNodeLeaseAlive(logger, etcdIpamClient)
+			}
+		}
+
+		// Same for the blocks of a YarpIPPool
+		if crdPool, ok := os.LookupEnv("CRD_IPAM_POOL"); ok {
+			dynamicClient, err := router.NewDynamicClient()
+			if err != nil {
+				logger.Error(err)
+				os.Exit(1)
+			}
+
+			routeController.BlockSources = append(routeController.BlockSources, ipam.NewCrdIpamClient(logger, dynamicClient, &ipam.CrdIpamClientConfig{
+				Pool:     crdPool,
+				NodeName: nodeName,
+			}))
+		}
+
+		// Optional kube-proxy replacement
+		if serviceProxy, _ := os.LookupEnv("SERVICE_PROXY"); serviceProxy == "true" {
+			go func() {
+				err := router.NewServiceProxy(logger, clientset, nodeName).Run(make(chan struct{}))
+				if err != nil {
+					logger.Error(err)
+					os.Exit(1)
+				}
+			}()
+		}
+
+		// Runs until the router is stopped
+		err = routeController.Run(make(chan struct{}))
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	} else {
 		cniArgs, errorResult := LoadCniEnvironmentValues()
 		if errorResult != nil {
 			response, err := errorResult.toString()
@@ -50,18 +120,132 @@ func main() {
 			os.Exit(0)
 		}
 
+		networkConfig, err := cni.LoadNetworkConfig(os.Stdin)
+		if err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+
+		interfaceSettings := im.InterfaceConfiguration{
+			NetworkName:         networkName(networkConfig),
+			StateDir:            filepath.Join(StateDir, networkName(networkConfig)),
+			Routes:              networkConfig.ResolveRoutes(),
+			SkipDefaultRoute:    networkConfig.SkipDefaultRoute,
+			Mode:                networkConfig.Mode,
+			Datapath:            networkConfig.Datapath,
+			FirewallBackend:     networkConfig.FirewallBackend,
+			Master:              networkConfig.Master,
+			Vlan:                networkConfig.Vlan,
+			MacvlanMode:         networkConfig.MacvlanMode,
+			IpvlanMode:          networkConfig.IpvlanMode,
+			BridgeName:          bridgeName(networkConfig),
+			Mtu:                 networkConfig.Mtu,
+			HairpinMode:         networkConfig.HairpinMode,
+			PromiscMode:         networkConfig.PromiscMode,
+			HostInterfacePrefix: im.DefaultHostInterfacePrefix,
+			HostSysctls:         networkConfig.HostSysctls,
+			ContainerSysctls:    networkConfig.ContainerSysctls,
+			AllowedPodSysctls:   networkConfig.AllowedPodSysctls,
+		}
+		// CNI_ARGS are only required to be valid on ADD, where the error is reported
+		extraArgs, extraArgsErr := cniArgs.ParseExtraArgs()
+		if extraArgsErr != nil {
+			extraArgs = map[string]string{}
+		}
+
+		ipamClient, err := newIpamClient(logger, networkConfig, cniArgs, extraArgs)
+		if err != nil {
+			exitWithError(logger, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  "unable to set up ipam",
+			})
+		}
+
+		interfaceClient, err := im.NewInterfaceManager(logger, interfaceSettings, ipamClient)
+		if err != nil {
+			exitWithError(logger, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  "invalid network config",
+			})
+		}
+
+		attachment := &im.AttachmentContext{
+			ContainerId:      cniArgs.ContainerId,
+			NetworkNamespace: cniArgs.NetworkNamespace,
+			InterfaceName:    cniArgs.InterfaceName,
+			RuntimeConfig:    networkConfig.RuntimeConfig,
+			PrevResult:       networkConfig.PrevResult,
+		}
+
 		switch cniArgs.Command {
 		case "ADD":
 			logger.Info(fmt.Sprintf("Received ADD request with %s", cniArgs))
-			cniResponse, cniErr := interfaceClient.CreateInterface(cniArgs.ContainerId, cniArgs.NetworkNamespace, cniArgs.InterfaceName)
-			cniResponse.Dns = dnSettings
-			cniResponse.CniVersion = CniVersion
+			if extraArgsErr != nil {
+				exitWithError(logger, &cni.ResultError{
+					ExitCode: 1,
+					Message:  extraArgsErr.Error(),
+					Details:  "unable to parse CNI_ARGS",
+				})
+			}
+
+			podAnnotations, err := loadPodAnnotations(extraArgs, networkConfig)
+			if err != nil {
+				exitWithError(logger, &cni.ResultError{
+					ExitCode: 1,
+					Message:  err.Error(),
+					Details:  "unable to load pod annotations",
+				})
+			}
+
+			requestedIp, err := resolveRequestedIp(logger, extraArgs, podAnnotations, networkConfig)
+			if err != nil {
+				exitWithError(logger, &cni.ResultError{
+					ExitCode: 1,
+					Message:  err.Error(),
+					Details:  "unable to resolve requested ip",
+				})
+			}
+
+			podSysctls, err := resolvePodSysctls(podAnnotations)
+			if err != nil {
+				exitWithError(logger, &cni.ResultError{
+					ExitCode: 1,
+					Message:  err.Error(),
+					Details:  "unable to resolve pod sysctls",
+				})
+			}
+
+			allowedSources, err := resolveAllowedSources(podAnnotations)
+			if err != nil {
+				exitWithError(logger, &cni.ResultError{
+					ExitCode: 1,
+					Message:  err.Error(),
+					Details:  "unable to resolve allowed sources",
+				})
+			}
+
+			attachment.RequestedIp = requestedIp
+			attachment.PodSysctls = podSysctls
+			attachment.AllowedSources = allowedSources
+			cniResponse, cniErr := interfaceClient.CreateInterface(attachment)
 			if cniErr != nil {
-				logger.Error(cniErr)
+				exitWithError(logger, cniErr)
+			}
+			// When chained after other plugins, our result extends the one we were handed over
+			if networkConfig.PrevResult != nil {
+				prevResult := networkConfig.PrevResult
+				prevResult.Append(cniResponse)
+				cniResponse = prevResult
+			}
+			if dns := networkConfig.ResolveDns(); dns != nil {
+				cniResponse.Dns = dns
 			}
+			cniResponse.CniVersion = resultVersion(networkConfig)
 			response, err := json.Marshal(cniResponse)
 			if err != nil {
-				fmt.Errorf("error decoding response of [%s]", err)
+				logger.Error(fmt.Sprintf("error decoding response of [%s]", err))
 				os.Exit(1)
 			}
 			fmt.Println(string(response))
@@ -69,32 +253,337 @@ func main() {
 			os.Exit(0)
 		case "DEL":
 			logger.Info(fmt.Sprintf("Received DEL request with %s", cniArgs))
-			cniResponse, cniErr := interfaceClient.DeleteInterface(cniArgs.ContainerId, cniArgs.NetworkNamespace, cniArgs.InterfaceName)
-			cniResponse.Dns = dnSettings
-			cniResponse.CniVersion = CniVersion
+			cniResponse, cniErr := interfaceClient.DeleteInterface(attachment)
 			if cniErr != nil {
-				logger.Error(cniErr)
+				exitWithError(logger, cniErr)
 			}
+			cniResponse.CniVersion = CniVersion
 			response, err := json.Marshal(cniResponse)
 			if err != nil {
-				fmt.Errorf("error decoding response of [%s]", err)
+				logger.Error(fmt.Sprintf("error decoding response of [%s]", err))
 				os.Exit(1)
 			}
 			fmt.Println(string(response))
 			logger.Info(string(response))
 			os.Exit(0)
+		case "CHECK":
+			logger.Info(fmt.Sprintf("Received CHECK request with %s", cniArgs))
+			cniErr := interfaceClient.CheckInterface(attachment)
+			if cniErr != nil {
+				exitWithError(logger, cniErr)
+			}
+			os.Exit(0)
 		case "VERSION":
 			logger.Info(fmt.Sprintf("Received VERSION request with %s", cniArgs))
-			fmt.Sprintln("{\"cniVersion\": %s}", CniVersion)
+			fmt.Printf("{\"cniVersion\": \"%s\"}\n", CniVersion)
 			os.Exit(0)
 		default:
 			logger.Info(fmt.Sprintf("Received [%s] request with %s", cniArgs.Command, cniArgs))
-			fmt.Errorf("unkown CNI_COMMAND. Expected [ADD, DEL] but go [%s]", cniArgs.Command)
+			logger.Error(fmt.Sprintf("unkown CNI_COMMAND. Expected [ADD, CHECK, DEL] but go [%s]", cniArgs.Command))
 			os.Exit(1)
 		}
 	}
 }
 
+// resultVersion echoes the cniVersion of the network config, as required when running inside a chain
+func resultVersion(networkConfig *cni.NetworkConfig) string {
+	if networkConfig.CniVersion != "" {
+		return networkConfig.CniVersion
+	}
+
+	return CniVersion
+}
+
+func networkName(networkConfig *cni.NetworkConfig) string {
+	if networkConfig.Name != "" {
+		return networkConfig.Name
+	}
+
+	return DefaultNetworkName
+}
+
+func bridgeName(networkConfig *cni.NetworkConfig) string {
+	if networkConfig.Bridge != "" {
+		return networkConfig.Bridge
+	}
+
+	return DefaultBridgeName
+}
+
+// ipamDbPath keeps one db per pool: a network with a subnet of its own gets a db named after it, while the
+// default network and the networks the router feeds share DefaultIpamDbPath
+func ipamDbPath(networkConfig *cni.NetworkConfig) string {
+	if networkConfig.Ipam.DbPath != "" {
+		return networkConfig.Ipam.DbPath
+	}
+
+	if networkConfig.Ipam.Subnet != "" && networkName(networkConfig) != DefaultNetworkName {
+		return filepath.Join(filepath.Dir(DefaultIpamDbPath), fmt.Sprintf("ipam-%s.db", networkName(networkConfig)))
+	}
+
+	return DefaultIpamDbPath
+}
+
+// newIpamClient serves the pool of the network from the local db, or from a YarpIPPool or etcd for the crd and etcd types
+func newIpamClient(logger *log.Logger, networkConfig *cni.NetworkConfig, cniArgs *CniArgs, extraArgs map[string]string) (ipam.IPAM, error) {
+	localClient := ipam.NewLocalIpamClient(logger, &ipam.LocalIpamClientConfig{
+		IpamDbPath:    ipamDbPath(networkConfig),
+		Subnet:        networkConfig.Ipam.Subnet,
+		ContainerId:   cniArgs.ContainerId,
+		InterfaceName: cniArgs.InterfaceName,
+	})
+
+	switch networkConfig.Ipam.Type {
+	case "", LocalIpamType:
+		// The gateway of a VLAN bridge comes from its db, which must not be the one of another bridge
+		if networkConfig.Vlan > 0 && networkConfig.Ipam.Subnet == "" && networkConfig.Ipam.DbPath == "" {
+			return nil, fmt.Errorf("vlan [%d] needs a pool of its own, set ipam.subnet", networkConfig.Vlan)
+		}
+
+		return localClient, nil
+	case CrdIpamType:
+		return newCrdIpamClient(logger, networkConfig, cniArgs, extraArgs, localClient)
+	case EtcdIpamType:
+		return newEtcdIpamClient(logger, networkConfig, cniArgs, extraArgs)
+	default:
+		return nil, fmt.Errorf("unknown ipam type [%s]", networkConfig.Ipam.Type)
+	}
+}
+
+// newCrdIpamClient serves the YarpIPPool of the network, from localClient while the API server is unreachable if fallbackToLocal is set
+func newCrdIpamClient(logger *log.Logger, networkConfig *cni.NetworkConfig, cniArgs *CniArgs, extraArgs map[string]string, localClient ipam.IPAM) (ipam.IPAM, error) {
+	if networkConfig.Kubernetes.Kubeconfig == "" {
+		return nil, fmt.Errorf("ipam type [%s] requires kubernetes.kubeconfig", CrdIpamType)
+	}
+
+	client, err := kube.NewDynamicClient(networkConfig.Kubernetes.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := networkConfig.Ipam.Pool
+	if pool == "" {
+		pool = ipam.DefaultPoolName
+	}
+
+	// Blocks are claimed under the node name the router routes them for
+	nodeName, err := kube.NodeName(networkConfig.Ipam.NodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	crdClient := ipam.NewCrdIpamClient(logger, client, &ipam.CrdIpamClientConfig{
+		Pool:          pool,
+		NodeName:      nodeName,
+		PodNamespace:  extraArgs["K8S_POD_NAMESPACE"],
+		PodName:       extraArgs["K8S_POD_NAME"],
+		ContainerId:   cniArgs.ContainerId,
+		InterfaceName: cniArgs.InterfaceName,
+	})
+	if networkConfig.Ipam.FallbackToLocal {
+		return ipam.NewFallbackIpamClient(logger, crdClient, localClient), nil
+	}
+
+	return crdClient, nil
+}
+
+func newEtcdIpamClient(logger *log.Logger, networkConfig *cni.NetworkConfig, cniArgs *CniArgs, extraArgs map[string]string) (ipam.IPAM, error) {
+	etcdConfig := networkConfig.Ipam.Etcd
+	if etcdConfig == nil || len(etcdConfig.Endpoints) == 0 {
+		return nil, fmt.Errorf("ipam type [%s] requires ipam.etcd.endpoints", EtcdIpamType)
+	}
+
+	client, err := ipam.NewEtcdClient(etcdConfig.Endpoints, etcdConfig.CertFile, etcdConfig.KeyFile, etcdConfig.CaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Must match the node name of the router, which keeps the lease of the node alive
+	nodeName, err := kube.NodeName(networkConfig.Ipam.NodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := networkConfig.Ipam.Pool
+	if pool == "" {
+		pool = ipam.DefaultPoolName
+	}
+
+	return ipam.NewEtcdIpamClient(logger, client, &ipam.EtcdIpamClientConfig{
+		Pool:          pool,
+		Subnet:        networkConfig.Ipam.Subnet,
+		BlockSize:     networkConfig.Ipam.BlockSize,
+		NodeName:      nodeName,
+		LeaseTtl:      etcdConfig.LeaseTtl,
+		PodNamespace:  extraArgs["K8S_POD_NAMESPACE"],
+		PodName:       extraArgs["K8S_POD_NAME"],
+		ContainerId:   cniArgs.ContainerId,
+		InterfaceName: cniArgs.InterfaceName,
+	}), nil
+}
+
+// newRouteController claims blocks of CLUSTER_POOL sized BLOCK_SIZE for the local ipam db at IPAM_DB_PATH
+func newRouteController(logger *log.Logger, clientset kubernetes.Interface, nodeName string) (*router.RouteController, error) {
+	pool, ok := os.LookupEnv("CLUSTER_POOL")
+	if !ok {
+		pool = router.DefaultClusterPool
+	}
+
+	blockSize := router.DefaultBlockSize
+	if value, ok := os.LookupEnv("BLOCK_SIZE"); ok {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BLOCK_SIZE: %w", err)
+		}
+		blockSize = size
+	}
+
+	dbPath, ok := os.LookupEnv("IPAM_DB_PATH")
+	if !ok {
+		dbPath = DefaultIpamDbPath
+	}
+
+	bridge, ok := os.LookupEnv("BRIDGE_NAME")
+	if !ok {
+		bridge = DefaultBridgeName
+	}
+
+	return router.NewRouteController(logger, clientset, nodeName, pool, blockSize, dbPath, bridge)
+}
+
+// newRouterEtcdIpamClient serves the IPAM_POOL pool of the etcd ipam, with the IPAM_LEASE_TTL lease if set
+func newRouterEtcdIpamClient(logger *log.Logger, nodeName string, endpoints []string) (*ipam.EtcdIpamClient, error) {
+	var leaseTtl int64
+	if value, ok := os.LookupEnv("IPAM_LEASE_TTL"); ok {
+		var err error
+		leaseTtl, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IPAM_LEASE_TTL: %w", err)
+		}
+	}
+
+	pool, ok := os.LookupEnv("IPAM_POOL")
+	if !ok {
+		pool = ipam.DefaultPoolName
+	}
+
+	client, err := ipam.NewEtcdClient(endpoints, os.Getenv("ETCD_CERT_FILE"), os.Getenv("ETCD_KEY_FILE"), os.Getenv("ETCD_CA_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	return ipam.NewEtcdIpamClient(logger, client, &ipam.EtcdIpamClientConfig{
+		Pool:     pool,
+		NodeName: nodeName,
+		LeaseTtl: leaseTtl,
+	}), nil
+}
+
+// keepNodeLeaseAlive renews the etcd ipam lease of the node forever, starting over whenever it is lost
+func keepNodeLeaseAlive(logger *log.Logger, ipamClient *ipam.EtcdIpamClient) {
+	for {
+		err := ipamClient.KeepNodeLeaseAlive(context.Background())
+		logger.Error(fmt.Sprintf("unable to keep the ipam lease of node [%s] alive: %s", ipamClient.Config.NodeName, err))
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// loadPodAnnotations fetches the annotations of the pod named in CNI_ARGS.
+// Nothing is fetched, and no error returned, when the pod or the kubeconfig are unknown.
+func loadPodAnnotations(extraArgs map[string]string, networkConfig *cni.NetworkConfig) (map[string]string, error) {
+	podNamespace, hasNamespace := extraArgs["K8S_POD_NAMESPACE"]
+	podName, hasName := extraArgs["K8S_POD_NAME"]
+	if !hasNamespace || !hasName || networkConfig.Kubernetes.Kubeconfig == "" {
+		return map[string]string{}, nil
+	}
+
+	clientset, err := kube.NewClientset(networkConfig.Kubernetes.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return kube.GetPodAnnotations(clientset, podNamespace, podName)
+}
+
+// resolveRequestedIp looks for a static ip request in runtimeConfig.ips, CNI_ARGS IP= and finally the pod annotation
+func resolveRequestedIp(logger *log.Logger, extraArgs map[string]string, podAnnotations map[string]string, networkConfig *cni.NetworkConfig) (net.IP, error) {
+	if len(networkConfig.RuntimeConfig.Ips) > 0 {
+		return parseRequestedIp(networkConfig.RuntimeConfig.Ips[0])
+	}
+
+	if ip, ok := extraArgs["IP"]; ok {
+		return parseRequestedIp(ip)
+	}
+
+	ip, ok := podAnnotations[kube.StaticIpAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	logger.Info(fmt.Sprintf("Pod requested ip [%s] via annotation", ip))
+	return parseRequestedIp(ip)
+}
+
+// resolvePodSysctls reads the container sysctls requested through the pod annotation, as a JSON object
+func resolvePodSysctls(podAnnotations map[string]string) (map[string]string, error) {
+	podSysctls := map[string]string{}
+	value, ok := podAnnotations[kube.SysctlsAnnotation]
+	if !ok {
+		return podSysctls, nil
+	}
+
+	err := json.Unmarshal([]byte(value), &podSysctls)
+	if err != nil {
+		return nil, fmt.Errorf("invalid [%s] annotation: %w", kube.SysctlsAnnotation, err)
+	}
+
+	return podSysctls, nil
+}
+
+// resolveAllowedSources reads the CIDRs a pod accepts connections from through the pod annotation, as a JSON list
+func resolveAllowedSources(podAnnotations map[string]string) ([]string, error) {
+	allowedSources := []string{}
+	value, ok := podAnnotations[kube.AllowedSourcesAnnotation]
+	if !ok {
+		return allowedSources, nil
+	}
+
+	err := json.Unmarshal([]byte(value), &allowedSources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid [%s] annotation: %w", kube.AllowedSourcesAnnotation, err)
+	}
+
+	return allowedSources, nil
+}
+
+// parseRequestedIp accepts both plain addresses and CIDR notation
+func parseRequestedIp(value string) (net.IP, error) {
+	ip, _, err := net.ParseCIDR(value)
+	if err == nil {
+		return ip, nil
+	}
+
+	ip = net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid requested ip [%s]", value)
+	}
+
+	return ip, nil
+}
+
+func exitWithError(logger *log.Logger, cniErr *cni.ResultError) {
+	cniErr.CniVersion = CniVersion
+	logger.Error(fmt.Sprintf("%s: %s", cniErr.Details, cniErr.Message))
+
+	response, err := json.Marshal(cniErr)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(255)
+	}
+	fmt.Println(string(response))
+	os.Exit(1)
+}
+
 func SetupLogging(pluginMode string) *log.Logger {
 	var logger = log.New()
 	logger.SetFormatter(&log.JSONFormatter{})
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"yarp-cni/pkg/cni"
+	"yarp-cni/pkg/kube"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestResolveRequestedIp(t *testing.T) {
+	annotation := map[string]string{kube.StaticIpAnnotation: "10.244.1.7"}
+	for _, test := range []struct {
+		name           string
+		runtimeIps     []string
+		extraArgs      map[string]string
+		podAnnotations map[string]string
+		expected       string
+		err            bool
+	}{
+		{name: "no request", expected: "<nil>"},
+		{name: "annotation", podAnnotations: annotation, expected: "10.244.1.7"},
+		{name: "CNI_ARGS over annotation", extraArgs: map[string]string{"IP": "10.244.1.6"}, podAnnotations: annotation, expected: "10.244.1.6"},
+		{name: "runtimeConfig over everything", runtimeIps: []string{"10.244.1.5/24"}, extraArgs: map[string]string{"IP": "10.244.1.6"}, podAnnotations: annotation, expected: "10.244.1.5"},
+		{name: "first of runtimeConfig", runtimeIps: []string{"10.244.1.5", "10.244.1.9"}, expected: "10.244.1.5"},
+		{name: "invalid CNI_ARGS not masked by the annotation", extraArgs: map[string]string{"IP": "10.244.1"}, podAnnotations: annotation, err: true},
+		{name: "invalid annotation", podAnnotations: map[string]string{kube.StaticIpAnnotation: "pod-a"}, err: true},
+	} {
+		networkConfig := &cni.NetworkConfig{RuntimeConfig: cni.RuntimeConfig{Ips: test.runtimeIps}}
+		ip, err := resolveRequestedIp(log.New(), test.extraArgs, test.podAnnotations, networkConfig)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got [%s]", test.name, ip)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(ip) != test.expected {
+			t.Errorf("%s: expected [%s], got [%s] (%v)", test.name, test.expected, ip, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package cni
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+type NetworkConfig struct {
+	CniVersion        string            `json:"cniVersion"`
+	Name              string            `json:"name"`
+	Type              string            `json:"type"`
+	Kubernetes        KubernetesConfig  `json:"kubernetes"`
+	Bridge            string            `json:"bridge,omitempty"`
+	Ipam              IpamConfig        `json:"ipam,omitempty"`
+	Routes            []Routes          `json:"routes,omitempty"`
+	SkipDefaultRoute  bool              `json:"skipDefaultRoute,omitempty"`
+	Mode              string            `json:"mode,omitempty"`
+	Datapath          string            `json:"datapath,omitempty"`
+	FirewallBackend   string            `json:"firewallBackend,omitempty"`
+	Master            string            `json:"master,omitempty"`
+	Vlan              int               `json:"vlan,omitempty"`
+	MacvlanMode       string            `json:"macvlanMode,omitempty"`
+	IpvlanMode        string            `json:"ipvlanMode,omitempty"`
+	Mtu               int               `json:"mtu,omitempty"`
+	HairpinMode       bool              `json:"hairpinMode,omitempty"`
+	PromiscMode       bool              `json:"promiscMode,omitempty"`
+	Dns               *Dns              `json:"dns,omitempty"`
+	HostSysctls       map[string]string `json:"hostSysctls,omitempty"`
+	ContainerSysctls  map[string]string `json:"containerSysctls,omitempty"`
+	AllowedPodSysctls []string          `json:"allowedPodSysctls,omitempty"`
+	RuntimeConfig     RuntimeConfig     `json:"runtimeConfig"`
+	PrevResult        *ResultSuccess    `json:"prevResult,omitempty"`
+}
+
+type KubernetesConfig struct {
+	Kubeconfig string `json:"kubeconfig"`
+}
+
+// IpamConfig lets each network keep its own pool, so that secondary networks don't draw from the primary one
+type IpamConfig struct {
+	Type   string   `json:"type,omitempty"`
+	Subnet string   `json:"subnet,omitempty"`
+	DbPath string   `json:"dbPath,omitempty"`
+	Routes []Routes `json:"routes,omitempty"`
+	// Pool is the YarpIPPool of the crd type
+	Pool string `json:"pool,omitempty"`
+	// FallbackToLocal serves the crd type from the local db while the API server is unreachable
+	FallbackToLocal bool `json:"fallbackToLocal,omitempty"`
+	// BlockSize is the prefix length of the blocks nodes claim from the pool of the etcd type
+	BlockSize int         `json:"blockSize,omitempty"`
+	NodeName  string      `json:"nodeName,omitempty"`
+	Etcd      *EtcdConfig `json:"etcd,omitempty"`
+}
+
+type EtcdConfig struct {
+	Endpoints []string `json:"endpoints"`
+	CertFile  string   `json:"certFile,omitempty"`
+	KeyFile   string   `json:"keyFile,omitempty"`
+	CaFile    string   `json:"caFile,omitempty"`
+	// LeaseTtl, in seconds, releases the blocks of a node whose router stopped renewing its lease
+	LeaseTtl int64 `json:"leaseTtl,omitempty"`
+}
+
+type RuntimeConfig struct {
+	Ips          []string      `json:"ips,omitempty"`
+	PortMappings []PortMapping `json:"portMappings,omitempty"`
+	Bandwidth    *Bandwidth    `json:"bandwidth,omitempty"`
+	Dns          *RuntimeDns   `json:"dns,omitempty"`
+}
+
+type PortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIp        string `json:"hostIP,omitempty"`
+}
+
+// Validate refuses ports out of 1-65535, which would wrap around to another port once programmed
+func (mapping PortMapping) Validate() error {
+	if mapping.HostPort < 1 || mapping.HostPort > 65535 {
+		return fmt.Errorf("invalid host port [%d]", mapping.HostPort)
+	}
+	if mapping.ContainerPort < 1 || mapping.ContainerPort > 65535 {
+		return fmt.Errorf("invalid container port [%d] for host port [%d]", mapping.ContainerPort, mapping.HostPort)
+	}
+
+	return nil
+}
+
+// Validate checks the capabilities only ADD makes use of. It is left to ADD, so that a DEL always goes through.
+func (config *RuntimeConfig) Validate() error {
+	for _, mapping := range config.PortMappings {
+		err := mapping.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid port mapping: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// RuntimeDns is the shape of the dns capability, which differs from the dns block of the result
+type RuntimeDns struct {
+	Servers  []string `json:"servers,omitempty"`
+	Domain   string   `json:"domain,omitempty"`
+	Searches []string `json:"searches,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// LoadNetworkConfig parses the network configuration handed over by the runtime on stdin.
+// An empty input is valid and yields an empty configuration.
+func LoadNetworkConfig(r io.Reader) (*NetworkConfig, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &NetworkConfig{}
+	if len(content) == 0 {
+		return config, nil
+	}
+
+	err = json.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Bandwidth rates are in bits per second and bursts in bits, as filled in by kubelet
+type Bandwidth struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+// ResolveRoutes lists the routes of the network followed by the ones of its ipam block
+func (config *NetworkConfig) ResolveRoutes() []Routes {
+	routes := []Routes{}
+	routes = append(routes, config.Routes...)
+	routes = append(routes, config.Ipam.Routes...)
+
+	return routes
+}
+
+// ResolveDns returns the dns settings of the network, with any field set in runtimeConfig.dns taking precedence.
+// It returns nil when neither configures dns, so that the block is omitted from the result.
+func (config *NetworkConfig) ResolveDns() *Dns {
+	dns := Dns{}
+	if config.Dns != nil {
+		dns = *config.Dns
+	}
+
+	if runtimeDns := config.RuntimeConfig.Dns; runtimeDns != nil {
+		if len(runtimeDns.Servers) > 0 {
+			dns.Nameservers = runtimeDns.Servers
+		}
+		if runtimeDns.Domain != "" {
+			dns.Domain = runtimeDns.Domain
+		}
+		if len(runtimeDns.Searches) > 0 {
+			dns.Search = runtimeDns.Searches
+		}
+		if len(runtimeDns.Options) > 0 {
+			dns.Options = runtimeDns.Options
+		}
+	}
+
+	if len(dns.Nameservers) == 0 && dns.Domain == "" && len(dns.Search) == 0 && len(dns.Options) == 0 {
+		return nil
+	}
+
+	return &dns
+}
@@ -0,0 +1,63 @@
+package cni
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mappings []PortMapping
+		err      string
+	}{
+		{name: "no mapping"},
+		{name: "bounds", mappings: []PortMapping{{HostPort: 1, ContainerPort: 65535}, {HostPort: 65535, ContainerPort: 1}}},
+		{name: "host port wrapping to 80", mappings: []PortMapping{{HostPort: 65616, ContainerPort: 80}}, err: "invalid host port [65616]"},
+		{name: "no host port", mappings: []PortMapping{{ContainerPort: 80}}, err: "invalid host port [0]"},
+		{name: "negative container port", mappings: []PortMapping{{HostPort: 8080, ContainerPort: -1}}, err: "invalid container port [-1]"},
+		{name: "container port too large", mappings: []PortMapping{{HostPort: 8080, ContainerPort: 80}, {HostPort: 8081, ContainerPort: 70000}}, err: "invalid container port [70000]"},
+	} {
+		err := (&RuntimeConfig{PortMappings: test.mappings}).Validate()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected [%s], got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestResolveDns(t *testing.T) {
+	networkDns := &Dns{Nameservers: []string{"10.96.0.53"}, Domain: "cluster.local", Search: []string{"svc.cluster.local"}, Options: []string{"ndots:5"}}
+	for _, test := range []struct {
+		name       string
+		dns        *Dns
+		runtimeDns *RuntimeDns
+		expected   *Dns
+	}{
+		{name: "nothing configured"},
+		{name: "empty runtime dns", runtimeDns: &RuntimeDns{}},
+		{name: "network only", dns: networkDns, expected: networkDns},
+		{name: "runtime only", runtimeDns: &RuntimeDns{Servers: []string{"10.0.0.10"}, Searches: []string{"default.svc.cluster.local"}}, expected: &Dns{
+			Nameservers: []string{"10.0.0.10"}, Search: []string{"default.svc.cluster.local"},
+		}},
+		{name: "runtime overrides per field", dns: networkDns, runtimeDns: &RuntimeDns{Servers: []string{"10.0.0.10"}, Options: []string{"ndots:2"}}, expected: &Dns{
+			Nameservers: []string{"10.0.0.10"}, Domain: "cluster.local", Search: []string{"svc.cluster.local"}, Options: []string{"ndots:2"},
+		}},
+	} {
+		config := &NetworkConfig{Dns: test.dns, RuntimeConfig: RuntimeConfig{Dns: test.runtimeDns}}
+		dns := config.ResolveDns()
+		if !reflect.DeepEqual(dns, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, dns)
+		}
+	}
+
+	// Resolving leaves the network config as it was
+	config := &NetworkConfig{Dns: networkDns, RuntimeConfig: RuntimeConfig{Dns: &RuntimeDns{Domain: "example.org"}}}
+	config.ResolveDns()
+	if config.Dns.Domain != "cluster.local" {
+		t.Fatalf("expected the network dns to be left untouched, got %+v", config.Dns)
+	}
+}
@@ -5,13 +5,26 @@ type ResultSuccess struct {
 	Interfaces []Interface `json:"interfaces"`
 	Ips        []Ip        `json:"ips"`
 	Routes     []Routes    `json:"routes"`
-	Dns        Dns         `json:"dns"`
+	Dns        *Dns        `json:"dns,omitempty"`
+}
+
+// Append merges the interfaces, ips and routes of other into the result.
+// Ip interface indexes of other are shifted to match their position in the merged interfaces list.
+func (result *ResultSuccess) Append(other *ResultSuccess) {
+	offset := len(result.Interfaces)
+	for _, ip := range other.Ips {
+		ip.Interface += offset
+		result.Ips = append(result.Ips, ip)
+	}
+
+	result.Interfaces = append(result.Interfaces, other.Interfaces...)
+	result.Routes = append(result.Routes, other.Routes...)
 }
 
 type Interface struct {
 	Name             string `json:"name"`
-	Mac              string `json:"mac"`
-	NetworkNamespace string `json:"sandbox"`
+	Mac              string `json:"mac,omitempty"`
+	NetworkNamespace string `json:"sandbox,omitempty"`
 }
 
 type Ip struct {
@@ -20,16 +33,18 @@ type Ip struct {
 	Interface int    `json:"interface"`
 }
 
+// Routes are both reported in results and read from the network config, where the gateway defaults to the network one
 type Routes struct {
 	Destination string `json:"dst"`
-	Gateway     string `json:"gw"`
+	Gateway     string `json:"gw,omitempty"`
+	Metric      int    `json:"metric,omitempty"`
 }
 
 type Dns struct {
-	Nameservers []string `json:"nameservers"`
-	Domain      string   `json:"domain"`
-	Search      []string `json:"search"`
-	Options     []string `json:"options"`
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
 }
 
 type ResultError struct {
@@ -0,0 +1,68 @@
+package cni
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	prevResult := &ResultSuccess{
+		Interfaces: []Interface{
+			{Name: "cni0", Mac: "ee:ee:ee:ee:ee:01"},
+			{Name: "eth0", Mac: "0a:58:0a:f4:00:02", NetworkNamespace: "/var/run/netns/c1"},
+		},
+		Ips:    []Ip{{Address: "10.244.0.2/24", Gateway: "10.244.0.1", Interface: 1}},
+		Routes: []Routes{{Destination: "0.0.0.0/0", Gateway: "10.244.0.1"}},
+		Dns:    &Dns{Nameservers: []string{"10.96.0.53"}},
+	}
+	result := &ResultSuccess{
+		Interfaces: []Interface{
+			{Name: "yarp1234", Mac: "ee:ee:ee:ee:ee:02"},
+			{Name: "net1", Mac: "0a:58:0a:f5:00:05", NetworkNamespace: "/var/run/netns/c1"},
+		},
+		Ips: []Ip{
+			{Address: "10.245.0.5/24", Gateway: "10.245.0.1", Interface: 1},
+			{Address: "10.245.0.1/24", Interface: 0},
+		},
+		Routes: []Routes{{Destination: "10.245.0.0/16", Gateway: "10.245.0.1"}},
+	}
+
+	prevResult.Append(result)
+
+	expected := &ResultSuccess{
+		Interfaces: []Interface{
+			{Name: "cni0", Mac: "ee:ee:ee:ee:ee:01"},
+			{Name: "eth0", Mac: "0a:58:0a:f4:00:02", NetworkNamespace: "/var/run/netns/c1"},
+			{Name: "yarp1234", Mac: "ee:ee:ee:ee:ee:02"},
+			{Name: "net1", Mac: "0a:58:0a:f5:00:05", NetworkNamespace: "/var/run/netns/c1"},
+		},
+		Ips: []Ip{
+			{Address: "10.244.0.2/24", Gateway: "10.244.0.1", Interface: 1},
+			{Address: "10.245.0.5/24", Gateway: "10.245.0.1", Interface: 3},
+			{Address: "10.245.0.1/24", Interface: 2},
+		},
+		Routes: []Routes{{Destination: "0.0.0.0/0", Gateway: "10.244.0.1"}, {Destination: "10.245.0.0/16", Gateway: "10.245.0.1"}},
+		Dns:    &Dns{Nameservers: []string{"10.96.0.53"}},
+	}
+	if !reflect.DeepEqual(prevResult, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, prevResult)
+	}
+
+	// The appended result keeps its own indexes
+	if result.Ips[0].Interface != 1 || result.Ips[1].Interface != 0 {
+		t.Fatalf("expected the appended result to be left untouched, got %+v", result.Ips)
+	}
+}
+
+func TestAppendToEmptyResult(t *testing.T) {
+	result := &ResultSuccess{
+		Interfaces: []Interface{{Name: "eth0"}},
+		Ips:        []Ip{{Address: "10.244.0.2/24", Interface: 0}},
+	}
+
+	prevResult := &ResultSuccess{}
+	prevResult.Append(result)
+	if !reflect.DeepEqual(prevResult.Interfaces, result.Interfaces) || !reflect.DeepEqual(prevResult.Ips, result.Ips) {
+		t.Fatalf("expected the result as is, got %+v", prevResult)
+	}
+}
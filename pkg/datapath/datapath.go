@@ -0,0 +1,138 @@
+package datapath
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultPinPath is where the endpoints map outlives the plugin invocations
+const DefaultPinPath = "/sys/fs/bpf/yarp"
+
+// filterPriority runs the program before the redirect to the ifb of the bandwidth limits
+const filterPriority = 1
+
+// Datapath holds the forwarding program and the map of the local pods it reads
+type Datapath struct {
+	Endpoints *ebpf.Map
+	Program   *ebpf.Program
+}
+
+// Load loads the program along with the endpoints map pinned in pinPath, which is created if missing.
+// An empty pinPath gives a private map, e.g. to run the program with TestRun.
+func Load(pinPath string) (*Datapath, error) {
+	mapSpec := endpointsMapSpec()
+	mapOptions := ebpf.MapOptions{}
+	if pinPath == "" {
+		mapSpec.Pinning = ebpf.PinNone
+	} else {
+		err := os.MkdirAll(pinPath, 0700)
+		if err != nil {
+			return nil, err
+		}
+		mapOptions.PinPath = pinPath
+	}
+
+	endpoints, err := ebpf.NewMapWithOptions(mapSpec, mapOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load map [%s]: %w", endpointsMapName, err)
+	}
+
+	programSpec := forwardingProgramSpec()
+	err = programSpec.Instructions.AssociateMap(endpointsMapName, endpoints)
+	if err != nil {
+		endpoints.Close()
+		return nil, err
+	}
+
+	program, err := ebpf.NewProgram(programSpec)
+	if err != nil {
+		endpoints.Close()
+		return nil, fmt.Errorf("unable to load program [%s]: %w", programSpec.Name, err)
+	}
+
+	return &Datapath{
+		Endpoints: endpoints,
+		Program:   program,
+	}, nil
+}
+
+func (datapath *Datapath) Close() {
+	datapath.Program.Close()
+	datapath.Endpoints.Close()
+}
+
+// AttachTo runs the program on the traffic the link receives, i.e. on what the pod behind a host veth sends.
+// The filter goes away with the link.
+func (datapath *Datapath) AttachTo(link netlink.Link) error {
+	err := ensureIngressHook(link)
+	if err != nil {
+		return err
+	}
+
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  filterPriority,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		Fd:           datapath.Program.FD(),
+		Name:         "yarp_forward",
+		DirectAction: true,
+	}
+
+	return netlink.FilterReplace(filter)
+}
+
+// ensureIngressHook adds a clsact qdisc, unless the link already has one, or an ingress qdisc, to attach filters to
+func ensureIngressHook(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+
+	for _, qdisc := range qdiscs {
+		if qdisc.Attrs().Parent == netlink.HANDLE_INGRESS {
+			return nil
+		}
+	}
+
+	return netlink.QdiscAdd(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	})
+}
+
+func (datapath *Datapath) SetEndpoint(ip net.IP, endpoint *Endpoint) error {
+	key, err := endpointKey(ip)
+	if err != nil {
+		return err
+	}
+
+	return datapath.Endpoints.Put(key, endpoint)
+}
+
+// DeleteEndpoint is a no-op for an address the map does not know
+func (datapath *Datapath) DeleteEndpoint(ip net.IP) error {
+	key, err := endpointKey(ip)
+	if err != nil {
+		return err
+	}
+
+	err = datapath.Endpoints.Delete(key)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil
+	}
+
+	return err
+}
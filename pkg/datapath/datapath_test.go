@@ -0,0 +1,137 @@
+package datapath
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+// loadTestDatapath loads the program with a private map, skipping where BPF is not available
+func loadTestDatapath(t *testing.T) *Datapath {
+	datapath, err := Load("")
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+		t.Skipf("unable to load the datapath: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(datapath.Close)
+
+	return datapath
+}
+
+// ipv4Packet crafts an ethernet frame holding an ipv4 header, followed by some payload
+func ipv4Packet(etherType uint16, srcMac net.HardwareAddr, dstMac net.HardwareAddr, src net.IP, dst net.IP) []byte {
+	packet := make([]byte, ethHeaderLen+20+8)
+	copy(packet[ethDst:], dstMac)
+	copy(packet[ethSrc:], srcMac)
+	binary.BigEndian.PutUint16(packet[ethProto:], etherType)
+
+	header := packet[ethHeaderLen:]
+	header[0] = 0x45
+	binary.BigEndian.PutUint16(header[2:], 20+8)
+	header[8] = 64
+	header[9] = 17
+	copy(header[12:], src.To4())
+	copy(header[16:], dst.To4())
+
+	return withTtl(packet, 64)
+}
+
+// withTtl sets the TTL of the ipv4 header and computes its checksum again
+func withTtl(packet []byte, ttl byte) []byte {
+	header := packet[ethHeaderLen : ethHeaderLen+20]
+	header[8] = ttl
+	header[10], header[11] = 0, 0
+
+	sum := uint32(0)
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(header[10:], ^uint16(sum))
+
+	return packet
+}
+
+func TestForwardingProgram(t *testing.T) {
+	datapath := loadTestDatapath(t)
+
+	podMac, _ := net.ParseMAC("0a:58:0a:f4:00:03")
+	hostMac, _ := net.ParseMAC("ee:ee:ee:ee:ee:03")
+	endpoint, err := NewEndpoint(42, podMac, hostMac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = datapath.SetEndpoint(net.ParseIP("10.244.0.3"), endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	senderMac, _ := net.ParseMAC("0a:58:0a:f4:00:02")
+	gatewayMac, _ := net.ParseMAC("ee:ee:ee:ee:ee:02")
+	source := net.ParseIP("10.244.0.2")
+
+	for _, test := range []struct {
+		name      string
+		packet    []byte
+		verdict   int32
+		rewritten bool
+	}{
+		{
+			name:      "local pod",
+			packet:    ipv4Packet(0x0800, senderMac, gatewayMac, source, net.ParseIP("10.244.0.3")),
+			verdict:   VerdictRedirect,
+			rewritten: true,
+		},
+		{
+			name:    "expiring TTL",
+			packet:  withTtl(ipv4Packet(0x0800, senderMac, gatewayMac, source, net.ParseIP("10.244.0.3")), 1),
+			verdict: VerdictPass,
+		},
+		{
+			name:    "remote address",
+			packet:  ipv4Packet(0x0800, senderMac, gatewayMac, source, net.ParseIP("10.244.1.3")),
+			verdict: VerdictPass,
+		},
+		{
+			name:    "not ipv4",
+			packet:  ipv4Packet(0x0806, senderMac, gatewayMac, source, net.ParseIP("10.244.0.3")),
+			verdict: VerdictPass,
+		},
+	} {
+		verdict, out, err := datapath.TestRun(test.packet)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if verdict != test.verdict {
+			t.Errorf("%s: expected verdict %d, got %d", test.name, test.verdict, verdict)
+		}
+
+		expected := test.packet
+		if test.rewritten {
+			expected = append([]byte{}, test.packet...)
+			copy(expected[ethDst:], podMac)
+			copy(expected[ethSrc:], hostMac)
+			withTtl(expected, test.packet[ipv4Ttl]-1)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("%s: expected packet %x, got %x", test.name, expected, out)
+		}
+	}
+
+	// Once the pod is gone, its traffic goes back to the kernel
+	err = datapath.DeleteEndpoint(net.ParseIP("10.244.0.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verdict, _, err := datapath.TestRun(ipv4Packet(0x0800, senderMac, gatewayMac, source, net.ParseIP("10.244.0.3")))
+	if err != nil || verdict != VerdictPass {
+		t.Fatalf("expected a deleted endpoint to pass, got %d (%v)", verdict, err)
+	}
+}
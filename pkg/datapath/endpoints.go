@@ -0,0 +1,67 @@
+package datapath
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+)
+
+const endpointsMapName = "yarp_endpoints"
+
+// maxEndpoints bounds the number of pods a node can run with the eBPF datapath
+const maxEndpoints = 16384
+
+// Offsets in Endpoint, as read by the program
+const (
+	endpointIfindex = 0
+	endpointPodMac  = 4
+	endpointHostMac = 12
+)
+
+// Endpoint is the value stored for every local pod ip. The layout is shared with the program,
+// the padding keeps both MACs 4 bytes aligned.
+type Endpoint struct {
+	HostIfindex uint32
+	PodMac      [6]byte
+	_           [2]byte
+	HostMac     [6]byte
+	_           [2]byte
+}
+
+func NewEndpoint(hostIfindex int, podMac net.HardwareAddr, hostMac net.HardwareAddr) (*Endpoint, error) {
+	if len(podMac) != 6 || len(hostMac) != 6 {
+		return nil, fmt.Errorf("invalid macs [%s] and [%s]", podMac, hostMac)
+	}
+
+	endpoint := &Endpoint{
+		HostIfindex: uint32(hostIfindex),
+	}
+	copy(endpoint.PodMac[:], podMac)
+	copy(endpoint.HostMac[:], hostMac)
+
+	return endpoint, nil
+}
+
+func endpointsMapSpec() *ebpf.MapSpec {
+	return &ebpf.MapSpec{
+		Name:       endpointsMapName,
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  20,
+		MaxEntries: maxEndpoints,
+		Pinning:    ebpf.PinByName,
+	}
+}
+
+// endpointKey is the ipv4 address in network order, as read from the packet
+func endpointKey(ip net.IP) ([4]byte, error) {
+	key := [4]byte{}
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return key, fmt.Errorf("[%s] is not an ipv4 address", ip)
+	}
+
+	copy(key[:], ipv4)
+	return key, nil
+}
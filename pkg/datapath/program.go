@@ -0,0 +1,112 @@
+package datapath
+
+import (
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// Return codes of tc programs running in direct action mode
+const (
+	tcActUnspec   = -1
+	tcActShot     = 2
+	tcActRedirect = 7
+)
+
+// Offsets in struct __sk_buff
+const (
+	skbData    = 76
+	skbDataEnd = 80
+)
+
+// Offsets in the packet, which starts with the ethernet header
+const (
+	ethDst       = 0
+	ethSrc       = 6
+	ethProto     = 12
+	ethHeaderLen = 14
+	ipv4Ttl      = ethHeaderLen + 8
+	ipv4Csum     = ethHeaderLen + 10
+	ipv4Daddr    = ethHeaderLen + 16
+)
+
+// ethPIpLoaded is ETH_P_IP (0x0800) as read by a little endian load of the network order field
+const ethPIpLoaded = 0x0008
+
+// forwardingInstructions is the program attached to the ingress of every host veth, i.e. to the traffic leaving a pod.
+// IPv4 packets to a pod of this node are rewritten as if they had been routed, TTL included, then moved straight
+// into the namespace of the destination pod with bpf_redirect_peer. Everything else, including packets whose TTL
+// expires here and are owed an ICMP error, goes on to the next filter and the kernel, whose routing table the
+// router maintains for the other nodes.
+func forwardingInstructions() asm.Instructions {
+	return asm.Instructions{
+		// r9 = skb, r6 = data, r7 = data_end
+		asm.Mov.Reg(asm.R9, asm.R1),
+		asm.LoadMem(asm.R6, asm.R1, skbData, asm.Word),
+		asm.LoadMem(asm.R7, asm.R1, skbDataEnd, asm.Word),
+
+		// Bail out unless the ethernet and the ipv4 header up to the destination address are there
+		asm.Mov.Reg(asm.R2, asm.R6),
+		asm.Add.Imm(asm.R2, ipv4Daddr+4),
+		asm.JGT.Reg(asm.R2, asm.R7, "pass"),
+		asm.LoadMem(asm.R2, asm.R6, ethProto, asm.Half),
+		asm.JNE.Imm(asm.R2, ethPIpLoaded, "pass"),
+
+		// Look the destination address up, as the key, on the stack
+		asm.LoadMem(asm.R2, asm.R6, ipv4Daddr, asm.Word),
+		asm.StoreMem(asm.RFP, -4, asm.R2, asm.Word),
+		asm.LoadMapPtr(asm.R1, 0).WithReference(endpointsMapName),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, -4),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+		asm.Mov.Reg(asm.R8, asm.R0),
+
+		// A packet whose TTL expires is left to the kernel
+		asm.LoadMem(asm.R2, asm.R6, ipv4Ttl, asm.Byte),
+		asm.JLE.Imm(asm.R2, 1, "pass"),
+
+		// Address the frame to the destination pod, from its host veth
+		asm.LoadMem(asm.R2, asm.R8, endpointPodMac, asm.Word),
+		asm.StoreMem(asm.R6, ethDst, asm.R2, asm.Word),
+		asm.LoadMem(asm.R2, asm.R8, endpointPodMac+4, asm.Half),
+		asm.StoreMem(asm.R6, ethDst+4, asm.R2, asm.Half),
+		asm.LoadMem(asm.R2, asm.R8, endpointHostMac, asm.Word),
+		asm.StoreMem(asm.R6, ethSrc, asm.R2, asm.Word),
+		asm.LoadMem(asm.R2, asm.R8, endpointHostMac+4, asm.Half),
+		asm.StoreMem(asm.R6, ethSrc+4, asm.R2, asm.Half),
+
+		// Decrement the TTL, the first byte of the ttl/protocol word, which is above 1 so nothing borrows
+		// from the protocol. bpf_l3_csum_replace(skb, offset, from, to, 2) then patches the header checksum.
+		asm.LoadMem(asm.R3, asm.R6, ipv4Ttl, asm.Half),
+		asm.Mov.Reg(asm.R4, asm.R3),
+		asm.Sub.Imm(asm.R4, 1),
+		asm.StoreMem(asm.R6, ipv4Ttl, asm.R4, asm.Half),
+		asm.Mov.Reg(asm.R1, asm.R9),
+		asm.Mov.Imm(asm.R2, ipv4Csum),
+		asm.Mov.Imm(asm.R5, 2),
+		asm.FnL3CsumReplace.Call(),
+		asm.JNE.Imm(asm.R0, 0, "drop"),
+
+		// bpf_redirect_peer(ifindex, 0) returns TC_ACT_REDIRECT on success
+		asm.LoadMem(asm.R1, asm.R8, endpointIfindex, asm.Word),
+		asm.Mov.Imm(asm.R2, 0),
+		asm.FnRedirectPeer.Call(),
+		asm.Return(),
+
+		// The packet was already rewritten, it cannot go on with a stale checksum
+		asm.Mov.Imm(asm.R0, tcActShot).WithSymbol("drop"),
+		asm.Return(),
+
+		asm.Mov.Imm(asm.R0, tcActUnspec).WithSymbol("pass"),
+		asm.Return(),
+	}
+}
+
+func forwardingProgramSpec() *ebpf.ProgramSpec {
+	return &ebpf.ProgramSpec{
+		Name:         "yarp_forward",
+		Type:         ebpf.SchedCLS,
+		License:      "GPL",
+		Instructions: forwardingInstructions(),
+	}
+}
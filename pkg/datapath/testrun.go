@@ -0,0 +1,19 @@
+package datapath
+
+// TestRun runs the program once over packet with BPF_PROG_TEST_RUN, no link or attachment involved.
+// It returns the verdict of the program and the packet as the program left it. Needs CAP_BPF, but no
+// particular hardware, so the datapath can be exercised from tests or a debugging tool.
+func (datapath *Datapath) TestRun(packet []byte) (int32, []byte, error) {
+	verdict, out, err := datapath.Program.Test(packet)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return int32(verdict), out, nil
+}
+
+// Verdicts TestRun can report
+const (
+	VerdictPass     = tcActUnspec
+	VerdictRedirect = tcActRedirect
+)
@@ -0,0 +1,190 @@
+package im
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"math"
+	"syscall"
+	"yarp-cni/pkg/cni"
+
+	"github.com/vishvananda/netlink"
+)
+
+const tbfLatencyInMillis = 25
+
+// applyBandwidthLimits shapes the pod traffic on the host side of the veth.
+// Traffic towards the pod leaves through the host veth and is shaped there by a TBF qdisc.
+// Traffic from the pod enters the host veth, so it is redirected to an ifb device whose egress is shaped instead.
+func (im *InterfaceManager) applyBandwidthLimits(hostLink netlink.Link, bandwidth *cni.Bandwidth) error {
+	err := validateBandwidth(bandwidth)
+	if err != nil {
+		return err
+	}
+
+	if bandwidth.IngressRate > 0 {
+		err = createTokenBucketFilter(hostLink.Attrs().Index, bandwidth.IngressRate, bandwidth.IngressBurst)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bandwidth.EgressRate > 0 {
+		ifbLink, err := createIfb(ifbName(hostLink.Attrs().Name), hostLink.Attrs().MTU)
+		if err != nil {
+			return err
+		}
+
+		err = redirectIngressTo(hostLink.Attrs().Index, ifbLink.Attrs().Index)
+		if err != nil {
+			return err
+		}
+
+		err = createTokenBucketFilter(ifbLink.Attrs().Index, bandwidth.EgressRate, bandwidth.EgressBurst)
+		if err != nil {
+			return err
+		}
+	}
+
+	im.Log.Info(fmt.Sprintf("Applied bandwidth limits [%+v] to [%s]", *bandwidth, hostLink.Attrs().Name))
+	return nil
+}
+
+// validateBandwidth checks both directions before anything is set up. The token bucket works in bytes,
+// so a rate or burst under 8 bits would be 0 and leave nothing to shape with. The kernel keeps the burst
+// and the queue limit on 32 bits, so larger ones would wrap around to a far smaller limit.
+func validateBandwidth(bandwidth *cni.Bandwidth) error {
+	for _, limit := range []struct {
+		direction string
+		rate      uint64
+		burst     uint64
+	}{
+		{direction: "ingress", rate: bandwidth.IngressRate, burst: bandwidth.IngressBurst},
+		{direction: "egress", rate: bandwidth.EgressRate, burst: bandwidth.EgressBurst},
+	} {
+		if limit.rate == 0 {
+			continue
+		}
+
+		if limit.burst == 0 {
+			return fmt.Errorf("%s burst must be set along with %s rate", limit.direction, limit.direction)
+		}
+		if limit.rate < 8 {
+			return fmt.Errorf("%s rate [%d] is under 1 byte per second", limit.direction, limit.rate)
+		}
+		if limit.burst < 8 {
+			return fmt.Errorf("%s burst [%d] is under 1 byte", limit.direction, limit.burst)
+		}
+		if limit.burst/8 > math.MaxUint32 {
+			return fmt.Errorf("%s burst [%d] is over %d bytes", limit.direction, limit.burst, uint32(math.MaxUint32))
+		}
+		if tbfLimitInBytes(limit.rate/8, limit.burst/8) > math.MaxUint32 {
+			return fmt.Errorf("%s rate [%d] and burst [%d] queue over %d bytes", limit.direction, limit.rate, limit.burst, uint32(math.MaxUint32))
+		}
+	}
+
+	return nil
+}
+
+// removeBandwidthLimits deletes the ifb device of the host veth, if any.
+// Qdiscs on the host veth go away together with the veth itself.
+func (im *InterfaceManager) removeBandwidthLimits(hostVirtualInterfaceName string) error {
+	ifbLink, err := netlink.LinkByName(ifbName(hostVirtualInterfaceName))
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	return netlink.LinkDel(ifbLink)
+}
+
+func createIfb(name string, mtu int) (netlink.Link, error) {
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	la.MTU = mtu
+	la.TxQLen = 32
+	err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: la})
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return link, netlink.LinkSetUp(link)
+}
+
+func redirectIngressTo(linkIndex int, targetIndex int) error {
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	err := netlink.QdiscAdd(ingress)
+	if err != nil {
+		return err
+	}
+
+	// Match every packet and redirect it to the egress of the target
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: linkIndex,
+			Parent:    ingress.Handle,
+			Priority:  2, // After the eBPF datapath, when enabled
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		ClassId:    netlink.MakeHandle(1, 1),
+		RedirIndex: targetIndex,
+		Actions:    []netlink.Action{netlink.NewMirredAction(targetIndex)},
+	}
+
+	return netlink.FilterAdd(filter)
+}
+
+func createTokenBucketFilter(linkIndex int, rateInBits uint64, burstInBits uint64) error {
+	rateInBytes := rateInBits / 8
+	burstInBytes := burstInBits / 8
+
+	// The buffer is the time the burst takes to go out at rate, in ticks the kernel keeps on 32 bits
+	bufferTime := float64(burstInBytes) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rateInBytes)
+	if bufferTime*netlink.TickInUsec() > math.MaxUint32 {
+		return fmt.Errorf("burst [%d] is too large for rate [%d]", burstInBits, rateInBits)
+	}
+	bufferInBytes := timeToTick(uint32(bufferTime))
+	limitInBytes := tbfLimitInBytes(rateInBytes, burstInBytes)
+	if limitInBytes > math.MaxUint32 {
+		return fmt.Errorf("rate [%d] and burst [%d] queue over %d bytes", rateInBits, burstInBits, uint32(math.MaxUint32))
+	}
+
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateInBytes,
+		Limit:  uint32(limitInBytes),
+		Buffer: bufferInBytes,
+	}
+
+	return netlink.QdiscAdd(tbf)
+}
+
+// tbfLimitInBytes is the queue of the token bucket: the burst plus what the rate sends out during the latency
+func tbfLimitInBytes(rateInBytes uint64, burstInBytes uint64) uint64 {
+	return uint64(float64(rateInBytes)*tbfLatencyInMillis/1000.0) + burstInBytes
+}
+
+func timeToTick(time uint32) uint32 {
+	return uint32(float64(time) * netlink.TickInUsec())
+}
+
+// ifbName derives the ifb device name from the host veth, keeping it under IFNAMSIZ
+func ifbName(hostVirtualInterfaceName string) string {
+	return fmt.Sprintf("ifb%x", sha1.Sum([]byte(hostVirtualInterfaceName)))[:15]
+}
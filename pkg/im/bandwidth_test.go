@@ -0,0 +1,35 @@
+package im
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"yarp-cni/pkg/cni"
+)
+
+func TestValidateBandwidth(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		bandwidth cni.Bandwidth
+		err       string
+	}{
+		{name: "no limit", bandwidth: cni.Bandwidth{}},
+		{name: "both directions", bandwidth: cni.Bandwidth{IngressRate: 1000000, IngressBurst: 80000, EgressRate: 8, EgressBurst: 8}},
+		{name: "burst without rate", bandwidth: cni.Bandwidth{IngressBurst: 80000}},
+		{name: "rate without burst", bandwidth: cni.Bandwidth{EgressRate: 1000000}, err: "egress burst must be set"},
+		{name: "rate under a byte", bandwidth: cni.Bandwidth{IngressRate: 7, IngressBurst: 80000}, err: "ingress rate [7] is under 1 byte per second"},
+		{name: "burst under a byte", bandwidth: cni.Bandwidth{IngressRate: 1000000, IngressBurst: 80000, EgressRate: 1000000, EgressBurst: 4}, err: "egress burst [4] is under 1 byte"},
+		{name: "burst over 32 bits", bandwidth: cni.Bandwidth{IngressRate: 1000000, IngressBurst: 8 << 32}, err: "ingress burst [34359738368] is over 4294967295 bytes"},
+		{name: "largest burst", bandwidth: cni.Bandwidth{IngressRate: 8, IngressBurst: 8 * math.MaxUint32}},
+		{name: "queue over 32 bits", bandwidth: cni.Bandwidth{EgressRate: 8 << 40, EgressBurst: 80000}, err: "egress rate [8796093022208] and burst [80000] queue over 4294967295 bytes"},
+		{name: "largest burst with a rate", bandwidth: cni.Bandwidth{IngressRate: 8000, IngressBurst: 8 * math.MaxUint32}, err: "queue over"},
+	} {
+		err := validateBandwidth(&test.bandwidth)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected [%s], got %v", test.name, test.err, err)
+		}
+	}
+}
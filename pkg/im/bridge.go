@@ -0,0 +1,242 @@
+package im
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// BridgeSquattedError is returned when the bridge name is taken by a link that is not a bridge
+type BridgeSquattedError struct {
+	Name     string
+	LinkType string
+}
+
+func (e *BridgeSquattedError) Error() string {
+	return fmt.Sprintf("link [%s] exists but is a [%s], not a bridge", e.Name, e.LinkType)
+}
+
+// bridgeName is the configured bridge, or the per-VLAN bridge (e.g. yarp0.100) when a VLAN is configured
+func (im *InterfaceManager) bridgeName() string {
+	if im.Configuration.Vlan > 0 {
+		return fmt.Sprintf("%s.%d", im.Configuration.BridgeName, im.Configuration.Vlan)
+	}
+
+	return im.Configuration.BridgeName
+}
+
+// vlanInterfaceName is the tagged sub-interface of the trunk, e.g. eth1.100
+func (im *InterfaceManager) vlanInterfaceName() string {
+	return fmt.Sprintf("%s.%d", im.Configuration.Master, im.Configuration.Vlan)
+}
+
+// ensureBridgeIsPresent creates the bridge when missing, or otherwise repairs the drift of an existing one
+func (im *InterfaceManager) ensureBridgeIsPresent() (*netlink.Bridge, error) {
+	link, err := netlink.LinkByName(im.bridgeName())
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, err
+		}
+
+		im.Log.Warn(fmt.Sprintf("Bridge [%s] does not exist", im.bridgeName()))
+		link, err = im.createBridge()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bridge, ok := link.(*netlink.Bridge)
+	if !ok {
+		return nil, &BridgeSquattedError{Name: im.bridgeName(), LinkType: link.Type()}
+	}
+
+	err = im.reconcileBridge(bridge)
+	if err != nil {
+		return nil, err
+	}
+
+	if im.Configuration.Vlan > 0 {
+		err = im.ensureVlanIsPlugged(bridge)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = im.applyHostSysctls()
+	if err != nil {
+		return nil, err
+	}
+
+	return bridge, nil
+}
+
+func (im *InterfaceManager) createBridge() (netlink.Link, error) {
+	la := netlink.NewLinkAttrs()
+	la.Name = im.bridgeName()
+	la.MTU = im.Configuration.Mtu
+	err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: la})
+	if err != nil {
+		return nil, err
+	}
+
+	im.Log.Warn(fmt.Sprintf("Bridge [%s] created", im.bridgeName()))
+	return netlink.LinkByName(im.bridgeName())
+}
+
+// reconcileBridge makes sure the bridge holds the gateway address, has the configured MTU, promiscuous and
+// hairpin settings and is up
+func (im *InterfaceManager) reconcileBridge(bridge *netlink.Bridge) error {
+	name := bridge.Attrs().Name
+
+	if im.Configuration.Mtu > 0 && bridge.Attrs().MTU != im.Configuration.Mtu {
+		im.Log.Warn(fmt.Sprintf("Bridge [%s] has MTU [%d] instead of [%d]. Fixing.", name, bridge.Attrs().MTU, im.Configuration.Mtu))
+		err := netlink.LinkSetMTU(bridge, im.Configuration.Mtu)
+		if err != nil {
+			return err
+		}
+	}
+
+	ip, ipNet, err := im.IpamClient.GetGatewayAddress()
+	if err != nil {
+		return err
+	}
+	ipNet.IP = ip
+
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	if !hasAddress(addrs, ipNet) {
+		im.Log.Warn(fmt.Sprintf("Bridge [%s] is missing gateway address [%s]. Fixing.", name, ipNet))
+		err = netlink.AddrAdd(bridge, &netlink.Addr{IPNet: ipNet, Label: ""})
+		if err != nil {
+			return err
+		}
+	}
+
+	if im.Configuration.PromiscMode && bridge.Attrs().Promisc == 0 {
+		im.Log.Warn(fmt.Sprintf("Bridge [%s] is not in promiscuous mode. Fixing.", name))
+		err = netlink.SetPromiscOn(bridge)
+		if err != nil {
+			return err
+		}
+	}
+
+	if im.Configuration.HairpinMode {
+		err = im.reconcileHairpinMode(bridge)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bridge.Attrs().Flags&net.FlagUp == 0 {
+		im.Log.Warn(fmt.Sprintf("Bridge [%s] is down. Fixing.", name))
+		err = netlink.LinkSetUp(bridge)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconcileHairpinMode enables hairpin on ports enslaved before the option was turned on
+func (im *InterfaceManager) reconcileHairpinMode(bridge *netlink.Bridge) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		if link.Attrs().MasterIndex != bridge.Attrs().Index {
+			continue
+		}
+
+		protinfo, err := netlink.LinkGetProtinfo(link)
+		if err != nil {
+			return err
+		}
+		if protinfo.Hairpin {
+			continue
+		}
+
+		im.Log.Warn(fmt.Sprintf("Port [%s] of bridge [%s] is not in hairpin mode. Fixing.", link.Attrs().Name, bridge.Attrs().Name))
+		err = netlink.LinkSetHairpin(link, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureVlanIsPlugged creates (or reuses) the VLAN sub-interface of the trunk and enslaves it to the bridge
+func (im *InterfaceManager) ensureVlanIsPlugged(bridge *netlink.Bridge) error {
+	name := im.vlanInterfaceName()
+	if len(name) > maxInterfaceNameLength {
+		return fmt.Errorf("vlan interface name [%s] is longer than %d chars", name, maxInterfaceNameLength)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return err
+		}
+
+		link, err = im.createVlanInterface(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	vlan, ok := link.(*netlink.Vlan)
+	if !ok || vlan.VlanId != im.Configuration.Vlan {
+		return fmt.Errorf("link [%s] exists but is not vlan [%d] of [%s]", name, im.Configuration.Vlan, im.Configuration.Master)
+	}
+
+	if vlan.Attrs().MasterIndex != bridge.Attrs().Index {
+		err = netlink.LinkSetMaster(vlan, bridge)
+		if err != nil {
+			return err
+		}
+	}
+
+	if vlan.Attrs().Flags&net.FlagUp == 0 {
+		err = netlink.LinkSetUp(vlan)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (im *InterfaceManager) createVlanInterface(name string) (netlink.Link, error) {
+	master, err := netlink.LinkByName(im.Configuration.Master)
+	if err != nil {
+		return nil, err
+	}
+
+	la := netlink.NewLinkAttrs()
+	la.Name = name
+	la.ParentIndex = master.Attrs().Index
+	la.MTU = im.Configuration.Mtu
+	err = netlink.LinkAdd(&netlink.Vlan{LinkAttrs: la, VlanId: im.Configuration.Vlan})
+	if err != nil {
+		return nil, err
+	}
+
+	im.Log.Warn(fmt.Sprintf("Vlan interface [%s] created", name))
+	return netlink.LinkByName(name)
+}
+
+func hasAddress(addrs []netlink.Addr, ipNet *net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IPNet.String() == ipNet.String() {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,52 @@
+package im
+
+import (
+	"net"
+	"yarp-cni/pkg/datapath"
+
+	"github.com/vishvananda/netlink"
+)
+
+// attachEbpfDatapath hooks the forwarding program on the host veth and makes the pod reachable through it
+func (im *InterfaceManager) attachEbpfDatapath(hostLink netlink.Link, podIp net.IP) error {
+	podMac, err := hardwareAddrFromIp(podIp)
+	if err != nil {
+		return err
+	}
+
+	dp, err := datapath.Load(datapath.DefaultPinPath)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+
+	err = dp.AttachTo(hostLink)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := datapath.NewEndpoint(hostLink.Attrs().Index, podMac, hostLink.Attrs().HardwareAddr)
+	if err != nil {
+		return err
+	}
+
+	return dp.SetEndpoint(podIp, endpoint)
+}
+
+// detachEbpfDatapath forgets the pod ips, the filter itself goes away with the host veth
+func (im *InterfaceManager) detachEbpfDatapath(ips []string) error {
+	dp, err := datapath.Load(datapath.DefaultPinPath)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+
+	for _, ip := range ips {
+		err = dp.DeleteEndpoint(net.ParseIP(ip))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package im
+
+import (
+	"net"
+	"yarp-cni/pkg/cni"
+)
+
+// FakeDriver records the attachments it is asked for and answers with canned results, without touching the host.
+// With Manager set, Del goes through the container interface deletion of the real drivers instead.
+type FakeDriver struct {
+	AddResult *cni.ResultSuccess
+	DelResult *cni.ResultSuccess
+	Err       *cni.ResultError
+	Manager   *InterfaceManager
+
+	Added   []*AttachmentContext
+	Checked []*AttachmentContext
+	Deleted []*AttachmentContext
+}
+
+func (driver *FakeDriver) Add(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	driver.Added = append(driver.Added, ctx)
+	if driver.Err != nil {
+		return nil, driver.Err
+	}
+
+	return driver.AddResult, nil
+}
+
+func (driver *FakeDriver) Check(ctx *AttachmentContext) *cni.ResultError {
+	driver.Checked = append(driver.Checked, ctx)
+	return driver.Err
+}
+
+func (driver *FakeDriver) Del(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	driver.Deleted = append(driver.Deleted, ctx)
+	if driver.Err != nil {
+		return nil, driver.Err
+	}
+	if driver.Manager != nil {
+		return driver.Manager.deleteContainerInterface(ctx)
+	}
+
+	return driver.DelResult, nil
+}
+
+// FakeIpam only keeps track of the owner of the addresses, the attachment key of each
+type FakeIpam struct {
+	Owners map[string]string
+}
+
+func (fakeIpam *FakeIpam) GetGatewayAddress() (net.IP, *net.IPNet, error) {
+	return net.ParseIP("10.244.0.1"), &net.IPNet{IP: net.ParseIP("10.244.0.1"), Mask: net.CIDRMask(24, 32)}, nil
+}
+
+func (fakeIpam *FakeIpam) AllocateIpv4Address() (net.IP, *net.IPNet, error) {
+	return nil, nil, nil
+}
+
+func (fakeIpam *FakeIpam) AllocateStaticIpv4Address(ip net.IP) (net.IP, *net.IPNet, error) {
+	return ip, &net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}, nil
+}
+
+func (fakeIpam *FakeIpam) DeAllocateIpv4Address(ip net.IP) error {
+	delete(fakeIpam.Owners, ip.String())
+	return nil
+}
+
+func (fakeIpam *FakeIpam) DeAllocateAttachment(containerId string, interfaceName string) ([]net.IP, error) {
+	released := []net.IP{}
+	for address, owner := range fakeIpam.Owners {
+		if owner == containerId+"/"+interfaceName {
+			delete(fakeIpam.Owners, address)
+			released = append(released, net.ParseIP(address))
+		}
+	}
+
+	return released, nil
+}
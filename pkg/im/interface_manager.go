@@ -1,11 +1,16 @@
 package im
 
 import (
+	"crypto/sha1"
 	"fmt"
+	"net"
+	"os"
 	"runtime"
 	"yarp-cni/pkg/cni"
 	"yarp-cni/pkg/ipam"
-	"yarp-cni/pkg/utils"
+	"yarp-cni/pkg/nft"
+	"yarp-cni/pkg/portmap"
+	"yarp-cni/pkg/state"
 
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
@@ -14,63 +19,281 @@ import (
 
 type InterfaceManager struct {
 	IpamClient    ipam.IPAM
+	PortMapper    *portmap.PortMapper
+	Nft           *nft.Manager
+	State         *state.Store
+	Driver        AttachmentDriver
 	Configuration InterfaceConfiguration
 	Log           *logrus.Logger
 }
 
-func NewInterfaceManager(logger *logrus.Logger, ic InterfaceConfiguration, ipamClient ipam.IPAM) *InterfaceManager {
+// NewInterfaceManager picks the attachment driver matching the configured mode
+func NewInterfaceManager(logger *logrus.Logger, ic InterfaceConfiguration, ipamClient ipam.IPAM) (*InterfaceManager, error) {
+	newDriver, ok := attachmentDrivers[ic.Mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown mode [%s]", ic.Mode)
+	}
+
+	switch ic.FirewallBackend {
+	case "", IptablesBackend, NftablesBackend:
+	default:
+		return nil, fmt.Errorf("unknown firewall backend [%s]", ic.FirewallBackend)
+	}
+
+	switch ic.Datapath {
+	case KernelDatapath:
+	case EbpfDatapath:
+		// The program stands in for the host routing between veths, there is no such hop with a bridge
+		if ic.Mode != RoutedMode {
+			return nil, fmt.Errorf("datapath [%s] requires mode [%s]", ic.Datapath, RoutedMode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown datapath [%s]", ic.Datapath)
+	}
+
+	if ic.Vlan < 0 || ic.Vlan > 4094 {
+		return nil, fmt.Errorf("invalid vlan [%d]", ic.Vlan)
+	}
+	if ic.Vlan > 0 {
+		// The VLAN sub-interface of master is plugged into the bridge, no other mode has one
+		if ic.Master == "" {
+			return nil, fmt.Errorf("vlan [%d] requires a master interface", ic.Vlan)
+		}
+		if ic.Mode != "" && ic.Mode != BridgeMode {
+			return nil, fmt.Errorf("vlan [%d] requires mode [%s]", ic.Vlan, BridgeMode)
+		}
+	}
+
+	im := &InterfaceManager{
+		IpamClient:    ipamClient,
+		PortMapper:    portmap.NewPortMapper(logger),
+		Nft:           nft.NewManager(logger, nft.DefaultStatePath),
+		State:         state.NewStore(ic.StateDir),
+		Configuration: ic,
+		Log:           logger,
+	}
+	im.Driver = newDriver(im)
+	return im, nil
+}
+
+// NewInterfaceManagerWithDriver uses the given driver whatever the mode, e.g. a FakeDriver in tests
+func NewInterfaceManagerWithDriver(logger *logrus.Logger, ic InterfaceConfiguration, ipamClient ipam.IPAM, driver AttachmentDriver) *InterfaceManager {
 	return &InterfaceManager{
 		IpamClient:    ipamClient,
+		PortMapper:    portmap.NewPortMapper(logger),
+		Nft:           nft.NewManager(logger, nft.DefaultStatePath),
+		State:         state.NewStore(ic.StateDir),
+		Driver:        driver,
 		Configuration: ic,
 		Log:           logger,
 	}
 }
 
-func (im *InterfaceManager) DeleteInterface(containerId string, namespacePath string, containerInterfaceName string) (*cni.ResultSuccess, *cni.ResultError) {
-	networkNsHandle, err := netns.GetFromPath(namespacePath)
+func (im *InterfaceManager) CreateInterface(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	containerSysctls, err := im.containerSysctls(ctx.InterfaceName, ctx.PodSysctls)
 	if err != nil {
 		return nil, &cni.ResultError{
 			ExitCode: 1,
 			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to load network namespace [%s]", namespacePath),
+			Details:  "invalid container sysctls",
 		}
 	}
+	ctx.ContainerSysctls = containerSysctls
 
-	result, cniErr := im.runInNetworkNamespace(
-		networkNsHandle,
-		func() (*cni.ResultSuccess, *cni.ResultError) {
-			containerVirtualInterface, err := netlink.LinkByName(containerInterfaceName)
+	err = ctx.RuntimeConfig.Validate()
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  "invalid runtime config",
+		}
+	}
+
+	if len(ctx.AllowedSources) > 0 && im.Configuration.FirewallBackend != NftablesBackend {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  fmt.Sprintf("firewall backend [%s] cannot isolate pods", im.Configuration.FirewallBackend),
+			Details:  "allowed sources require the nftables backend",
+		}
+	}
+
+	result, cniErr := im.Driver.Add(ctx)
+	if cniErr != nil {
+		return nil, cniErr
+	}
+
+	err = im.State.Save(im.attachmentState(ctx, result))
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to record attachment [%s] of container [%s]", ctx.InterfaceName, ctx.ContainerId),
+		}
+	}
+
+	return result, nil
+}
+
+func (im *InterfaceManager) CheckInterface(ctx *AttachmentContext) *cni.ResultError {
+	cniErr := im.loadState(ctx)
+	if cniErr != nil {
+		return cniErr
+	}
+
+	return im.Driver.Check(ctx)
+}
+
+func (im *InterfaceManager) DeleteInterface(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	cniErr := im.loadState(ctx)
+	if cniErr != nil {
+		return nil, cniErr
+	}
+
+	var err error
+	if im.Configuration.FirewallBackend == NftablesBackend {
+		err = im.Nft.DeleteEndpoint(ctx.key())
+	} else {
+		err = im.PortMapper.DeleteMappings(ctx.key())
+	}
+	if err != nil {
+		im.Log.Warn(fmt.Sprintf("unable to delete port mappings of container [%s]: %s", ctx.ContainerId, err))
+	}
+
+	result, cniErr := im.Driver.Del(ctx)
+	if cniErr != nil {
+		return nil, cniErr
+	}
+
+	err = im.State.Delete(ctx.ContainerId, ctx.InterfaceName)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to forget attachment [%s] of container [%s]", ctx.InterfaceName, ctx.ContainerId),
+		}
+	}
+
+	return result, nil
+}
+
+func (im *InterfaceManager) loadState(ctx *AttachmentContext) *cni.ResultError {
+	attachment, err := im.State.Load(ctx.ContainerId, ctx.InterfaceName)
+	if err != nil {
+		return &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to load attachment [%s] of container [%s]", ctx.InterfaceName, ctx.ContainerId),
+		}
+	}
+
+	ctx.State = attachment
+	return nil
+}
+
+// attachmentState extracts from the ADD result the host interface and the ips of the container interface
+func (im *InterfaceManager) attachmentState(ctx *AttachmentContext, result *cni.ResultSuccess) *state.Attachment {
+	attachment := &state.Attachment{
+		ContainerId:   ctx.ContainerId,
+		InterfaceName: ctx.InterfaceName,
+		Network:       im.Configuration.NetworkName,
+		Ips:           []string{},
+	}
+
+	for _, cniInterface := range result.Interfaces {
+		if cniInterface.NetworkNamespace == "" {
+			attachment.HostInterface = cniInterface.Name
+		}
+	}
+
+	for _, ip := range result.Ips {
+		address, _, err := net.ParseCIDR(ip.Address)
+		if err == nil {
+			attachment.Ips = append(attachment.Ips, address.String())
+		}
+	}
+
+	return attachment
+}
+
+// deleteContainerInterface releases the ips of the container interface and deletes it.
+// The ips recorded at ADD are released even when the namespace is already gone. Without a record, they are read
+// off the link, or released from IPAM by container and interface once the link is gone too: a missing namespace
+// or link is always a success, as DEL is retried until it succeeds.
+func (im *InterfaceManager) deleteContainerInterface(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	cniResponse := &cni.ResultSuccess{
+		Interfaces: []cni.Interface{
+			{
+				Name:             ctx.InterfaceName,
+				NetworkNamespace: ctx.NetworkNamespace,
+			},
+		},
+		Ips: []cni.Ip{},
+	}
+
+	if ctx.State != nil {
+		for _, address := range ctx.State.Ips {
+			ip := net.ParseIP(address)
+			err := im.IpamClient.DeAllocateIpv4Address(ip)
 			if err != nil {
 				return nil, &cni.ResultError{
 					ExitCode: 1,
 					Message:  err.Error(),
-					Details:  fmt.Sprintf("unable to fetch link [%s]", containerInterfaceName),
+					Details:  fmt.Sprintf("unable to deallocate ip [%s]", ip),
 				}
 			}
 
-			v4addr, err := netlink.AddrList(containerVirtualInterface, netlink.FAMILY_V4)
+			cniResponse.Ips = append(cniResponse.Ips, cni.Ip{
+				Address: ip.String(),
+			})
+		}
+	}
+
+	networkNsHandle, err := netns.GetFromPath(ctx.NetworkNamespace)
+	if os.IsNotExist(err) {
+		im.Log.Warn(fmt.Sprintf("Network namespace [%s] is gone, nothing left to delete", ctx.NetworkNamespace))
+		return im.releaseAttachmentIps(ctx, cniResponse)
+	}
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to load network namespace [%s]", ctx.NetworkNamespace),
+		}
+	}
+	defer networkNsHandle.Close()
+
+	linkFound := true
+	linkIps := []net.IP{}
+	_, cniErr := im.runInNetworkNamespace(
+		networkNsHandle,
+		func() (*cni.ResultSuccess, *cni.ResultError) {
+			containerVirtualInterface, err := netlink.LinkByName(ctx.InterfaceName)
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				linkFound = false
+				return nil, nil
+			}
 			if err != nil {
 				return nil, &cni.ResultError{
 					ExitCode: 1,
 					Message:  err.Error(),
-					Details:  fmt.Sprintf("unable to fetch addr in [%s]", containerInterfaceName),
+					Details:  fmt.Sprintf("unable to fetch link [%s]", ctx.InterfaceName),
 				}
 			}
 
-			ips := []cni.Ip{}
-			for _, ip := range v4addr {
-				err = im.IpamClient.DeAllocateIpv4Address(ip.IP)
+			// Attachments made before state was recorded are released from the addresses on the link
+			if ctx.State == nil {
+				v4addr, err := netlink.AddrList(containerVirtualInterface, netlink.FAMILY_V4)
 				if err != nil {
 					return nil, &cni.ResultError{
 						ExitCode: 1,
 						Message:  err.Error(),
-						Details:  fmt.Sprintf("unable to deallocate ip [%s]", ip.IP),
+						Details:  fmt.Sprintf("unable to fetch addr in [%s]", ctx.InterfaceName),
 					}
 				}
 
-				ips = append(ips, cni.Ip{
-					Address: ip.IP.String(),
-				})
+				for _, addr := range v4addr {
+					linkIps = append(linkIps, addr.IP)
+				}
 			}
 
 			err = netlink.LinkDel(containerVirtualInterface)
@@ -78,259 +301,421 @@ func (im *InterfaceManager) DeleteInterface(containerId string, namespacePath st
 				return nil, &cni.ResultError{
 					ExitCode: 1,
 					Message:  err.Error(),
-					Details:  fmt.Sprintf("unable to delete link [%s]", containerVirtualInterface),
+					Details:  fmt.Sprintf("unable to delete link [%s]", ctx.InterfaceName),
 				}
 			}
 
-			cniResponse := cni.ResultSuccess{
-				Interfaces: []cni.Interface{
-					{
-						Name:             containerInterfaceName,
-						NetworkNamespace: namespacePath,
-					},
-				},
-				Ips: ips,
-				Routes: []cni.Routes{
-					{
-						Destination: "0.0.0.0/0",
-					},
-				},
-			}
-			return &cniResponse, nil
+			return nil, nil
 		})
 	if cniErr != nil {
 		return nil, cniErr
 	}
+	if !linkFound {
+		im.Log.Warn(fmt.Sprintf("Link [%s] is gone from network namespace [%s], nothing left to delete", ctx.InterfaceName, ctx.NetworkNamespace))
+		return im.releaseAttachmentIps(ctx, cniResponse)
+	}
 
-	return result, nil
+	// Released from the host namespace, where IPAM can be reached
+	for _, ip := range linkIps {
+		err = im.IpamClient.DeAllocateIpv4Address(ip)
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to deallocate ip [%s]", ip),
+			}
+		}
+
+		cniResponse.Ips = append(cniResponse.Ips, cni.Ip{
+			Address: ip.String(),
+		})
+	}
+
+	return cniResponse, nil
 }
 
-func (im *InterfaceManager) CreateInterface(containerId string, namespacePath string, containerInterfaceName string) (*cni.ResultSuccess, *cni.ResultError) {
-	err := im.ensureBridgeIsPresent()
-	if err != nil {
-		return nil, &cni.ResultError{
-			ExitCode: 1,
-			Message:  err.Error(),
-			Details:  "unable to create bridge",
-		}
+// releaseAttachmentIps releases, for an attachment without state and without link, the ips IPAM recorded for it.
+// There is nothing to release when the state is gone along with a previous DEL, which released them already.
+func (im *InterfaceManager) releaseAttachmentIps(ctx *AttachmentContext, cniResponse *cni.ResultSuccess) (*cni.ResultSuccess, *cni.ResultError) {
+	releaser, ok := im.IpamClient.(ipam.AttachmentReleaser)
+	if ctx.State != nil || !ok {
+		return cniResponse, nil
 	}
 
-	networkNsHandle, err := netns.GetFromPath(namespacePath)
+	ips, err := releaser.DeAllocateAttachment(ctx.ContainerId, ctx.InterfaceName)
 	if err != nil {
 		return nil, &cni.ResultError{
 			ExitCode: 1,
 			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to load network namespace [%s]", namespacePath),
+			Details:  fmt.Sprintf("unable to deallocate the ips of attachment [%s] of container [%s]", ctx.InterfaceName, ctx.ContainerId),
 		}
 	}
 
-	hostVirtualInterfaceName := utils.TruncateString(containerId, 8)
-	hostVirtualInterfaceAttrs := netlink.NewLinkAttrs()
-	hostVirtualInterfaceAttrs.Name = hostVirtualInterfaceName
+	for _, ip := range ips {
+		cniResponse.Ips = append(cniResponse.Ips, cni.Ip{
+			Address: ip.String(),
+		})
+	}
 
-	containerVirtualInterfaceAttrs := netlink.NewLinkAttrs()
-	containerVirtualInterfaceAttrs.Namespace = networkNsHandle
-	containerVirtualInterfaceAttrs.Name = containerInterfaceName
+	return cniResponse, nil
+}
 
-	virtualLinkInterface := &netlink.Veth{
-		LinkAttrs: hostVirtualInterfaceAttrs,
-		PeerName:  containerInterfaceName,
-	}
-	err = netlink.LinkAdd(virtualLinkInterface)
+// checkContainerInterface verifies the container interface is up and still holds the ips reported for it in prevResult
+func (im *InterfaceManager) checkContainerInterface(ctx *AttachmentContext) *cni.ResultError {
+	networkNsHandle, err := netns.GetFromPath(ctx.NetworkNamespace)
 	if err != nil {
-		return nil, &cni.ResultError{
+		return &cni.ResultError{
 			ExitCode: 1,
 			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to add paired veth [%s<->%s]", hostVirtualInterfaceName, containerInterfaceName),
+			Details:  fmt.Sprintf("unable to load network namespace [%s]", ctx.NetworkNamespace),
 		}
 	}
 
-	bridgeLink, err := netlink.LinkByName(im.Configuration.BridgeName)
+	_, cniErr := im.runInNetworkNamespace(
+		networkNsHandle,
+		func() (*cni.ResultSuccess, *cni.ResultError) {
+			containerLink, err := netlink.LinkByName(ctx.InterfaceName)
+			if err != nil {
+				return nil, &cni.ResultError{
+					ExitCode: 1,
+					Message:  err.Error(),
+					Details:  fmt.Sprintf("unable to fetch link [%s]", ctx.InterfaceName),
+				}
+			}
+
+			if containerLink.Attrs().Flags&net.FlagUp == 0 {
+				return nil, &cni.ResultError{
+					ExitCode: 1,
+					Message:  fmt.Sprintf("link [%s] is down", ctx.InterfaceName),
+					Details:  "container interface is not up",
+				}
+			}
+
+			addrs, err := netlink.AddrList(containerLink, netlink.FAMILY_V4)
+			if err != nil {
+				return nil, &cni.ResultError{
+					ExitCode: 1,
+					Message:  err.Error(),
+					Details:  fmt.Sprintf("unable to fetch addr in [%s]", ctx.InterfaceName),
+				}
+			}
+
+			for _, expected := range ctx.expectedIps() {
+				if !hasAddress(addrs, expected) {
+					return nil, &cni.ResultError{
+						ExitCode: 1,
+						Message:  fmt.Sprintf("ip [%s] is missing from [%s]", expected, ctx.InterfaceName),
+						Details:  "container interface lost its ip",
+					}
+				}
+			}
+
+			return nil, nil
+		})
+
+	return cniErr
+}
+
+// configureContainerInterface allocates the pod ip and sets up the addresses and routes of the container interface.
+// It returns the pod ip along with the mask of the pool it was allocated from.
+// hostLink is the host end of the veth, nil for attachments without one (macvlan, ipvlan).
+// Must be called from within the container network namespace.
+func (im *InterfaceManager) configureContainerInterface(ctx *AttachmentContext, hostLink netlink.Link) (_ *cni.ResultSuccess, _ *net.IPNet, cniErr *cni.ResultError) {
+	containerVirtualInterface, err := netlink.LinkByName(ctx.InterfaceName)
 	if err != nil {
-		return nil, &cni.ResultError{
+		return nil, nil, &cni.ResultError{
 			ExitCode: 1,
 			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to fetch link [%s]", im.Configuration.BridgeName),
+			Details:  fmt.Sprintf("unable to fetch link [%s]", ctx.InterfaceName),
 		}
 	}
 
-	hostLink, err := netlink.LinkByName(hostVirtualInterfaceName)
+	// Sysctls requested by the pod are the likeliest to fail, so they go before anything is allocated
+	err = applySysctls(ctx.ContainerSysctls)
 	if err != nil {
-		return nil, &cni.ResultError{
+		return nil, nil, &cni.ResultError{
 			ExitCode: 1,
 			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to fetch link [%s]", hostVirtualInterfaceName),
+			Details:  fmt.Sprintf("unable to apply sysctls in network namespace [%s]", ctx.NetworkNamespace),
 		}
 	}
 
-	err = netlink.LinkSetMaster(hostLink, bridgeLink.(*netlink.Bridge))
+	ip, ipNet, err := im.allocateIp(ctx.RequestedIp)
 	if err != nil {
-		return nil, &cni.ResultError{
+		return nil, nil, &cni.ResultError{
 			ExitCode: 1,
 			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to link [%s] to bridge [%s]", hostVirtualInterfaceName, im.Configuration.BridgeName),
+			Details:  "unable to allocate ip",
 		}
 	}
 
-	err = netlink.LinkSetUp(hostLink)
-	if err != nil {
-		return nil, &cni.ResultError{
-			ExitCode: 1,
-			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to enable link [%s]", hostVirtualInterfaceName),
+	// No state is recorded for a failed attachment, so its DEL could only find the address on the link:
+	// on failure the address is taken off the link and released here
+	var ipAddr *netlink.Addr
+	defer func() {
+		if cniErr == nil {
+			return
+		}
+
+		if ipAddr != nil {
+			err := netlink.AddrDel(containerVirtualInterface, ipAddr)
+			if err != nil {
+				im.Log.Warn(fmt.Sprintf("unable to detach ip [%s] from interface [%s]: %s", ip, ctx.InterfaceName, err))
+			}
+		}
+
+		err := im.IpamClient.DeAllocateIpv4Address(ip)
+		if err != nil {
+			im.Log.Warn(fmt.Sprintf("unable to release ip [%s] of the failed attachment: %s", ip, err))
+		}
+	}()
+
+	// A MAC derived from the ip keeps ARP caches valid when a pod comes back with the same ip.
+	// ipvlan links share the MAC of their master, so they are left alone.
+	if _, isIpvlan := containerVirtualInterface.(*netlink.IPVlan); !isIpvlan {
+		mac, err := hardwareAddrFromIp(ip)
+		if err != nil {
+			return nil, nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to set a mac on link [%s]", ctx.InterfaceName),
+			}
+		}
+		err = netlink.LinkSetHardwareAddr(containerVirtualInterface, mac)
+		if err != nil {
+			return nil, nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to set mac [%s] on link [%s]", mac, ctx.InterfaceName),
+			}
 		}
 	}
 
-	containerVirtualInterface, err := netlink.LinkByName(containerInterfaceName)
+	err = netlink.LinkSetUp(containerVirtualInterface)
 	if err != nil {
-		return nil, &cni.ResultError{
+		return nil, nil, &cni.ResultError{
 			ExitCode: 1,
 			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to fetch link [%s]", containerInterfaceName),
+			Details:  fmt.Sprintf("unable to enable link [%s]", ctx.InterfaceName),
 		}
 	}
 
-	err = netlink.LinkSetNsFd(containerVirtualInterface, int(networkNsHandle))
+	ipNet.IP = ip
+	network := &net.IPNet{IP: ip.Mask(ipNet.Mask), Mask: ipNet.Mask}
+	if im.Configuration.Mode == RoutedMode {
+		// Pods do not share a L2 domain, every other address is reached through the gateway
+		ipNet.Mask = net.CIDRMask(32, 32)
+	}
+	address := &netlink.Addr{IPNet: ipNet, Label: ""}
+	err = netlink.AddrAdd(containerVirtualInterface, address)
 	if err != nil {
-		return nil, &cni.ResultError{
+		return nil, nil, &cni.ResultError{
 			ExitCode: 1,
 			Message:  err.Error(),
-			Details:  fmt.Sprintf("unable to move link [%s] to network namespace [%s]", containerInterfaceName, namespacePath),
+			Details:  fmt.Sprintf("unable to attach ip [%s] to interface [%s]", ip.To4().String(), ctx.InterfaceName),
 		}
 	}
-
-	result, cniErr := im.runInNetworkNamespace(
-		networkNsHandle,
-		func() (*cni.ResultSuccess, *cni.ResultError) {
-			err = netlink.LinkSetUp(containerVirtualInterface)
-			if err != nil {
-				return nil, &cni.ResultError{
-					ExitCode: 1,
-					Message:  err.Error(),
-					Details:  fmt.Sprintf("unable to enable link [%s]", containerInterfaceName),
-				}
-			}
-
-			ip, ipNet, err := im.IpamClient.AllocateIpv4Address()
-			if err != nil {
-				return nil, &cni.ResultError{
-					ExitCode: 1,
-					Message:  err.Error(),
-					Details:  "unable to allocate ip",
-				}
+	ipAddr = address
+
+	var gwIp net.IP
+	if im.Configuration.Mode == RoutedMode {
+		gwIp = routedGatewayIp
+		err = configureRoutedGateway(containerVirtualInterface, hostLink.Attrs().HardwareAddr)
+		if err != nil {
+			return nil, nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to reach gateway in network namespace [%s]", ctx.NetworkNamespace),
 			}
-
-			ipNet.IP = ip
-			ipAddr := &netlink.Addr{IPNet: ipNet, Label: ""}
-			err = netlink.AddrAdd(containerVirtualInterface, ipAddr)
-			if err != nil {
-				return nil, &cni.ResultError{
-					ExitCode: 1,
-					Message:  err.Error(),
-					Details:  fmt.Sprintf("unable to attach ip [%s] to interface [%s]", ip.To4().String(), containerInterfaceName),
-				}
+		}
+	} else {
+		gwIp, _, err = im.IpamClient.GetGatewayAddress()
+		if err != nil {
+			return nil, nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  "unable to get gateway address",
 			}
+		}
 
-			gwIp, _, err := im.IpamClient.GetGatewayAddress()
+		// Pods of a block claimed later on sit outside the subnet of the gateway, which is still on the bridge
+		if !network.Contains(gwIp) {
+			err = netlink.RouteAdd(&netlink.Route{
+				LinkIndex: containerVirtualInterface.Attrs().Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       &net.IPNet{IP: gwIp, Mask: net.CIDRMask(32, 32)},
+			})
 			if err != nil {
-				return nil, &cni.ResultError{
+				return nil, nil, &cni.ResultError{
 					ExitCode: 1,
 					Message:  err.Error(),
-					Details:  "unable to get gateway address",
+					Details:  fmt.Sprintf("unable to reach gateway [%s] in network namespace [%s]", gwIp, ctx.NetworkNamespace),
 				}
 			}
+		}
+	}
 
-			route := &netlink.Route{
-				Scope: netlink.SCOPE_UNIVERSE,
-				Gw:    gwIp,
-			}
-			err = netlink.RouteAdd(route)
-			if err != nil {
-				return nil, &cni.ResultError{
-					ExitCode: 1,
-					Message:  err.Error(),
-					Details:  fmt.Sprintf("unable to create route in network namespace [%s]", namespacePath),
-				}
-			}
+	routes, err := im.containerRoutes(ctx, network, gwIp)
+	if err != nil {
+		return nil, nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  "invalid routes in network config",
+		}
+	}
 
-			cniResponse := cni.ResultSuccess{
-				Interfaces: []cni.Interface{
-					{
-						Name:             containerInterfaceName,
-						NetworkNamespace: namespacePath,
-					},
-				},
-				Ips: []cni.Ip{
-					{
-						Address:   ipNet.String(),
-						Gateway:   gwIp.String(),
-						Interface: 1, // We can assume its 1 in this implementation. 0 for loopback device, 1 for eth0
-					},
-				},
-				Routes: []cni.Routes{
-					{
-						Destination: "0.0.0.0/0",
-						Gateway:     gwIp.String(),
-					},
-				},
+	for _, route := range routes {
+		err = addContainerRoute(containerVirtualInterface, route)
+		if err != nil {
+			return nil, nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to create route [%s] in network namespace [%s]", route.Destination, ctx.NetworkNamespace),
 			}
+		}
+	}
 
-			return &cniResponse, nil
-		})
-
-	if cniErr != nil {
-		return nil, cniErr
+	// Read the link back to report the MAC the kernel ended up with
+	containerLink, err := netlink.LinkByName(ctx.InterfaceName)
+	if err != nil {
+		return nil, nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to fetch link [%s]", ctx.InterfaceName),
+		}
 	}
 
+	interfaces := []cni.Interface{
+		{
+			Name:             ctx.InterfaceName,
+			Mac:              containerLink.Attrs().HardwareAddr.String(),
+			NetworkNamespace: ctx.NetworkNamespace,
+		},
+	}
 	cniResponse := cni.ResultSuccess{
-		Interfaces: []cni.Interface{
+		Interfaces: interfaces,
+		Ips: []cni.Ip{
 			{
-				Name: hostVirtualInterfaceName,
+				Address:   ipNet.String(),
+				Gateway:   gwIp.String(),
+				Interface: len(interfaces) - 1, // Relative to this result, shifted once merged with the host side
 			},
 		},
+		Routes: routes,
 	}
 
-	cniResponse.Interfaces = append(cniResponse.Interfaces, result.Interfaces...)
-	cniResponse.Ips = append(cniResponse.Ips, result.Ips...)
-	cniResponse.Routes = append(cniResponse.Routes, result.Routes...)
-	return &cniResponse, nil
+	return &cniResponse, &net.IPNet{IP: ip, Mask: network.Mask}, nil
 }
 
-func (im *InterfaceManager) ensureBridgeIsPresent() error {
-	_, err := netlink.LinkByName(im.Configuration.BridgeName)
-	if err == nil {
-		im.Log.Warn("Bridge already created. Skipping.")
-		return nil
+// containerRoutes lists the routes to install for the attachment, the configured ones after the default one.
+// A configured gateway must be on-link, i.e. in the pod network or the network gateway itself.
+// Only the primary interface gets the default route, unless skipped. A secondary routed interface still needs
+// a route to its network, which a bridged one gets for free from its address.
+func (im *InterfaceManager) containerRoutes(ctx *AttachmentContext, network *net.IPNet, gwIp net.IP) ([]cni.Routes, error) {
+	routes := []cni.Routes{}
+	if ctx.isPrimary() && !im.Configuration.SkipDefaultRoute {
+		routes = append(routes, cni.Routes{Destination: "0.0.0.0/0", Gateway: gwIp.String()})
+	} else if im.Configuration.Mode == RoutedMode {
+		routes = append(routes, cni.Routes{Destination: network.String(), Gateway: gwIp.String()})
 	}
-	im.Log.Warn(fmt.Sprintf("Bridge [%s] does not exist", im.Configuration.BridgeName))
 
-	la := netlink.NewLinkAttrs()
-	la.Name = im.Configuration.BridgeName
-	bridge := &netlink.Bridge{LinkAttrs: la}
-	err = netlink.LinkAdd(bridge)
-	if err != nil {
-		return err
+	for _, route := range im.Configuration.Routes {
+		_, _, err := net.ParseCIDR(route.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route destination [%s]: %w", route.Destination, err)
+		}
+
+		if route.Gateway == "" {
+			route.Gateway = gwIp.String()
+		}
+		gateway := net.ParseIP(route.Gateway)
+		if gateway == nil {
+			return nil, fmt.Errorf("invalid gateway [%s] for route [%s]", route.Gateway, route.Destination)
+		}
+		// The pod only has an on-link route to its network and to the network gateway
+		if !network.Contains(gateway) && !gateway.Equal(gwIp) {
+			return nil, fmt.Errorf("gateway [%s] for route [%s] is not reachable from [%s]", route.Gateway, route.Destination, network)
+		}
+
+		routes = append(routes, route)
 	}
 
-	ip, ipNet, err := im.IpamClient.GetGatewayAddress()
+	return routes, nil
+}
+
+// addContainerRoute installs a route through the container interface.
+// Must be called from within the container network namespace.
+func addContainerRoute(containerLink netlink.Link, route cni.Routes) error {
+	_, destination, err := net.ParseCIDR(route.Destination)
 	if err != nil {
 		return err
 	}
-	ipNet.IP = ip
-	ipAddr := &netlink.Addr{IPNet: ipNet, Label: ""}
 
-	err = netlink.AddrAdd(bridge, ipAddr)
-	if err != nil {
-		return err
+	return netlink.RouteAdd(&netlink.Route{
+		LinkIndex: containerLink.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       destination,
+		Gw:        net.ParseIP(route.Gateway),
+		Priority:  route.Metric,
+	})
+}
+
+// podNetwork is the pool an address was allocated from
+func podNetwork(address *net.IPNet) *net.IPNet {
+	return &net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}
+}
+
+// hardwareAddrFromIp builds a locally administered unicast MAC (0a:58 followed by the ipv4 bytes)
+func hardwareAddrFromIp(ip net.IP) (net.HardwareAddr, error) {
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return nil, fmt.Errorf("unable to derive a mac from [%s], which is not an ipv4 address", ip)
 	}
 
-	err = netlink.LinkSetUp(bridge)
-	if err != nil {
+	return net.HardwareAddr{0x0a, 0x58, ipv4[0], ipv4[1], ipv4[2], ipv4[3]}, nil
+}
+
+// allocateIp honours a requested static address and otherwise picks the next free one
+func (im *InterfaceManager) allocateIp(requestedIp net.IP) (net.IP, *net.IPNet, error) {
+	if requestedIp != nil {
+		return im.IpamClient.AllocateStaticIpv4Address(requestedIp)
+	}
+
+	return im.IpamClient.AllocateIpv4Address()
+}
+
+// hostVirtualInterfaceName derives the host veth name from a hash of the container id and interface name,
+// so that it is stable across ADD and DEL and distinct for every attachment of a pod. The separator keeps
+// e.g. container "ab" with "ceth0" apart from container "abc" with "eth0".
+func (im *InterfaceManager) hostVirtualInterfaceName(containerId string, containerInterfaceName string) (string, error) {
+	prefix := im.Configuration.HostInterfacePrefix
+	if prefix == "" {
+		prefix = DefaultHostInterfacePrefix
+	}
+
+	hashLength := maxInterfaceNameLength - len(prefix)
+	if hashLength < minInterfaceHashLength {
+		return "", fmt.Errorf("host interface prefix [%s] leaves less than %d chars for the hash", prefix, minInterfaceHashLength)
+	}
+
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(containerId+"/"+containerInterfaceName)))
+	return prefix + hash[:hashLength], nil
+}
+
+// removeStaleLinks drops the host veth, and ifb device, left behind by a previous failed ADD
+func (im *InterfaceManager) removeStaleLinks(hostVirtualInterfaceName string) error {
+	link, err := netlink.LinkByName(hostVirtualInterfaceName)
+	if err == nil {
+		im.Log.Warn(fmt.Sprintf("Link [%s] already exists. Deleting it.", hostVirtualInterfaceName))
+		err = netlink.LinkDel(link)
+		if err != nil {
+			return err
+		}
+	} else if _, ok := err.(netlink.LinkNotFoundError); !ok {
 		return err
 	}
 
-	im.Log.Warn(fmt.Sprintf("Bridge [%s] created with IP: [%s]", im.Configuration.BridgeName, ip.To4().String()))
-	return nil
+	return im.removeBandwidthLimits(hostVirtualInterfaceName)
 }
 
 func (im *InterfaceManager) runInNetworkNamespace(networkNamespace netns.NsHandle, f func() (*cni.ResultSuccess, *cni.ResultError)) (*cni.ResultSuccess, *cni.ResultError) {
@@ -0,0 +1,332 @@
+package im
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"yarp-cni/pkg/cni"
+	"yarp-cni/pkg/state"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestInterfaceManager(t *testing.T, ic InterfaceConfiguration, driver *FakeDriver) *InterfaceManager {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	ic.NetworkName = "yarp"
+	ic.StateDir = t.TempDir()
+
+	return NewInterfaceManagerWithDriver(logger, ic, nil, driver)
+}
+
+func newTestAttachmentContext() *AttachmentContext {
+	return &AttachmentContext{
+		ContainerId:      "c1",
+		NetworkNamespace: "/var/run/netns/c1",
+		InterfaceName:    "eth0",
+	}
+}
+
+func fakeAddResult() *cni.ResultSuccess {
+	return &cni.ResultSuccess{
+		Interfaces: []cni.Interface{
+			{Name: "veth1234", Mac: "ee:ee:ee:ee:ee:02"},
+			{Name: "eth0", Mac: "0a:58:0a:f4:00:02", NetworkNamespace: "/var/run/netns/c1"},
+		},
+		Ips: []cni.Ip{{Address: "10.244.0.2/24", Gateway: "10.244.0.1", Interface: 1}},
+	}
+}
+
+func TestAddCheckDelLifecycle(t *testing.T) {
+	driver := &FakeDriver{AddResult: fakeAddResult(), DelResult: &cni.ResultSuccess{}}
+	im := newTestInterfaceManager(t, InterfaceConfiguration{
+		ContainerSysctls:  map[string]string{"net.ipv4.conf.all.forwarding": "0"},
+		AllowedPodSysctls: []string{"net.ipv4.conf.*.accept_redirects"},
+	}, driver)
+
+	ctx := newTestAttachmentContext()
+	ctx.PodSysctls = map[string]string{"net.ipv4.conf.eth0.accept_redirects": "0"}
+	result, cniErr := im.CreateInterface(ctx)
+	if cniErr != nil {
+		t.Fatal(cniErr.Message)
+	}
+	if !reflect.DeepEqual(result, driver.AddResult) || len(driver.Added) != 1 {
+		t.Fatalf("expected the result of the driver, got %+v", result)
+	}
+
+	// Configured and pod sysctls are merged for the driver
+	expectedSysctls := map[string]string{"net.ipv4.conf.all.forwarding": "0", "net.ipv4.conf.eth0.accept_redirects": "0"}
+	if !reflect.DeepEqual(driver.Added[0].ContainerSysctls, expectedSysctls) {
+		t.Fatalf("unexpected container sysctls %v", driver.Added[0].ContainerSysctls)
+	}
+
+	// CHECK and DEL get what ADD recorded, even without prevResult
+	expectedState := &state.Attachment{ContainerId: "c1", InterfaceName: "eth0", Network: "yarp", HostInterface: "veth1234", Ips: []string{"10.244.0.2"}}
+	cniErr = im.CheckInterface(newTestAttachmentContext())
+	if cniErr != nil {
+		t.Fatal(cniErr.Message)
+	}
+	if len(driver.Checked) != 1 || !reflect.DeepEqual(driver.Checked[0].State, expectedState) {
+		t.Fatalf("expected CHECK to get the recorded state, got %+v", driver.Checked)
+	}
+
+	_, cniErr = im.DeleteInterface(newTestAttachmentContext())
+	if cniErr != nil {
+		t.Fatal(cniErr.Message)
+	}
+	if len(driver.Deleted) != 1 || !reflect.DeepEqual(driver.Deleted[0].State, expectedState) {
+		t.Fatalf("expected DEL to get the recorded state, got %+v", driver.Deleted)
+	}
+
+	// The state goes away with the attachment, a second DEL finds nothing
+	attachment, err := im.State.Load("c1", "eth0")
+	if err != nil || attachment != nil {
+		t.Fatalf("expected the state to be deleted, got %+v (%v)", attachment, err)
+	}
+	_, cniErr = im.DeleteInterface(newTestAttachmentContext())
+	if cniErr != nil {
+		t.Fatal(cniErr.Message)
+	}
+	if len(driver.Deleted) != 2 || driver.Deleted[1].State != nil {
+		t.Fatal("expected a second DEL to reach the driver without state")
+	}
+}
+
+func TestDelIsIdempotent(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		add      bool
+		owners   map[string]string
+		released [][]string
+	}{
+		{
+			name:     "recorded attachment",
+			add:      true,
+			owners:   map[string]string{"10.244.0.2": "c1/eth0", "10.244.0.3": "c2/eth0"},
+			released: [][]string{{"10.244.0.2"}, {}},
+		},
+		{
+			// Made before state was recorded, or its ADD failed to record it
+			name:     "attachment without state",
+			owners:   map[string]string{"10.244.0.2": "c1/eth0", "10.244.0.3": "c1/net1"},
+			released: [][]string{{"10.244.0.2"}, {}},
+		},
+	} {
+		fakeIpam := &FakeIpam{Owners: test.owners}
+		driver := &FakeDriver{AddResult: fakeAddResult()}
+		im := newTestInterfaceManager(t, InterfaceConfiguration{}, driver)
+		im.IpamClient = fakeIpam
+		driver.Manager = im
+
+		if test.add {
+			_, cniErr := im.CreateInterface(newTestAttachmentContext())
+			if cniErr != nil {
+				t.Fatal(cniErr.Message)
+			}
+		}
+
+		// The network namespace is gone, as it is once the pod is
+		for i, expected := range test.released {
+			result, cniErr := im.DeleteInterface(newTestAttachmentContext())
+			if cniErr != nil {
+				t.Fatalf("%s: DEL %d failed: %s (%s)", test.name, i+1, cniErr.Message, cniErr.Details)
+			}
+
+			released := []string{}
+			for _, ip := range result.Ips {
+				released = append(released, ip.Address)
+			}
+			if !reflect.DeepEqual(released, expected) {
+				t.Errorf("%s: expected DEL %d to release %v, got %v", test.name, i+1, expected, released)
+			}
+		}
+
+		if len(fakeIpam.Owners) != 1 {
+			t.Errorf("%s: expected the other attachment to keep its ip, got %v", test.name, fakeIpam.Owners)
+		}
+	}
+}
+
+func TestAddRejectedBeforeTheDriver(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		podSysctls     map[string]string
+		allowedSources []string
+		portMappings   []cni.PortMapping
+		details        string
+	}{
+		{name: "pod sysctl not allowed", podSysctls: map[string]string{"net.ipv4.ip_forward": "0"}, details: "invalid container sysctls"},
+		{name: "isolation without nftables", allowedSources: []string{"10.0.0.0/8"}, details: "allowed sources require the nftables backend"},
+		{name: "host port out of range", portMappings: []cni.PortMapping{{HostPort: 65616, ContainerPort: 80}}, details: "invalid runtime config"},
+	} {
+		driver := &FakeDriver{AddResult: fakeAddResult()}
+		im := newTestInterfaceManager(t, InterfaceConfiguration{}, driver)
+
+		ctx := newTestAttachmentContext()
+		ctx.PodSysctls = test.podSysctls
+		ctx.AllowedSources = test.allowedSources
+		ctx.RuntimeConfig.PortMappings = test.portMappings
+		_, cniErr := im.CreateInterface(ctx)
+		if cniErr == nil || cniErr.Details != test.details {
+			t.Errorf("%s: expected [%s], got %+v", test.name, test.details, cniErr)
+		}
+		if len(driver.Added) != 0 {
+			t.Errorf("%s: expected the driver not to be called", test.name)
+		}
+	}
+}
+
+func TestFailedAddRecordsNothing(t *testing.T) {
+	driver := &FakeDriver{Err: &cni.ResultError{ExitCode: 1, Message: "boom", Details: "driver failure"}}
+	im := newTestInterfaceManager(t, InterfaceConfiguration{}, driver)
+
+	_, cniErr := im.CreateInterface(newTestAttachmentContext())
+	if cniErr == nil || cniErr.Details != "driver failure" {
+		t.Fatalf("expected the error of the driver, got %+v", cniErr)
+	}
+
+	attachment, err := im.State.Load("c1", "eth0")
+	if err != nil || attachment != nil {
+		t.Fatalf("expected no state for a failed ADD, got %+v (%v)", attachment, err)
+	}
+}
+
+func TestNewInterfaceManagerValidatesConfiguration(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		ic   InterfaceConfiguration
+		err  string
+	}{
+		{name: "unknown mode", ic: InterfaceConfiguration{Mode: "tunnel"}, err: "unknown mode"},
+		{name: "unknown backend", ic: InterfaceConfiguration{FirewallBackend: "pf"}, err: "unknown firewall backend"},
+		{name: "ebpf on a bridge", ic: InterfaceConfiguration{Datapath: EbpfDatapath}, err: "requires mode [routed]"},
+		{name: "vlan without master", ic: InterfaceConfiguration{Vlan: 100}, err: "requires a master interface"},
+		{name: "vlan out of range", ic: InterfaceConfiguration{Vlan: 4095, Master: "eth1"}, err: "invalid vlan"},
+		{name: "vlan in routed mode", ic: InterfaceConfiguration{Mode: RoutedMode, Vlan: 100, Master: "eth1"}, err: "requires mode [bridge]"},
+		{name: "vlan on a bridge", ic: InterfaceConfiguration{Mode: BridgeMode, Vlan: 100, Master: "eth1"}},
+		{name: "defaults", ic: InterfaceConfiguration{}},
+	} {
+		_, err := NewInterfaceManager(logrus.New(), test.ic, nil)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected [%s], got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestHostVirtualInterfaceName(t *testing.T) {
+	im := newTestInterfaceManager(t, InterfaceConfiguration{}, &FakeDriver{})
+
+	name, err := im.hostVirtualInterfaceName("c1", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(name, DefaultHostInterfacePrefix) || len(name) != maxInterfaceNameLength {
+		t.Fatalf("expected a %d chars name under the default prefix, got [%s]", maxInterfaceNameLength, name)
+	}
+
+	again, err := im.hostVirtualInterfaceName("c1", "eth0")
+	if err != nil || again != name {
+		t.Fatalf("expected the same name for the same attachment, got [%s] and [%s] (%v)", name, again, err)
+	}
+
+	for _, attachment := range [][2]string{{"c1", "net1"}, {"c2", "eth0"}, {"c", "1eth0"}} {
+		other, err := im.hostVirtualInterfaceName(attachment[0], attachment[1])
+		if err != nil || other == name {
+			t.Fatalf("expected a distinct name for %v, got [%s] (%v)", attachment, other, err)
+		}
+	}
+
+	im.Configuration.HostInterfacePrefix = "pod"
+	name, err = im.hostVirtualInterfaceName("c1", "eth0")
+	if err != nil || !strings.HasPrefix(name, "pod") || len(name) != maxInterfaceNameLength {
+		t.Fatalf("expected a %d chars name under the custom prefix, got [%s] (%v)", maxInterfaceNameLength, name, err)
+	}
+
+	im.Configuration.HostInterfacePrefix = "yarpvethhost"
+	_, err = im.hostVirtualInterfaceName("c1", "eth0")
+	if err == nil {
+		t.Fatal("expected a prefix leaving no room for the hash to be refused")
+	}
+}
+
+func TestHardwareAddrFromIp(t *testing.T) {
+	for _, test := range []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "10.244.1.5", expected: "0a:58:0a:f4:01:05"},
+		{ip: "192.168.255.254", expected: "0a:58:c0:a8:ff:fe"},
+		{ip: "::ffff:10.244.1.5", expected: "0a:58:0a:f4:01:05"},
+	} {
+		mac, err := hardwareAddrFromIp(net.ParseIP(test.ip))
+		if err != nil || mac.String() != test.expected {
+			t.Errorf("%s: expected [%s], got [%s] (%v)", test.ip, test.expected, mac, err)
+		}
+	}
+
+	for _, ip := range []net.IP{net.ParseIP("fd00::5"), nil} {
+		_, err := hardwareAddrFromIp(ip)
+		if err == nil {
+			t.Errorf("%s: expected a non ipv4 address to be refused", ip)
+		}
+	}
+}
+
+func TestContainerRoutes(t *testing.T) {
+	_, podNetwork, _ := net.ParseCIDR("10.244.0.0/24")
+	podGateway := net.ParseIP("10.244.0.1")
+	_, blockNetwork, _ := net.ParseCIDR("10.244.3.0/24")
+	for _, test := range []struct {
+		name          string
+		ic            InterfaceConfiguration
+		interfaceName string
+		network       *net.IPNet
+		expected      []cni.Routes
+		err           string
+	}{
+		{name: "default route only", expected: []cni.Routes{{Destination: "0.0.0.0/0", Gateway: "10.244.0.1"}}},
+		{name: "configured routes after the default one", ic: InterfaceConfiguration{Routes: []cni.Routes{
+			{Destination: "10.96.0.0/12", Metric: 100},
+			{Destination: "192.168.0.0/16", Gateway: "10.244.0.254"},
+		}}, expected: []cni.Routes{
+			{Destination: "0.0.0.0/0", Gateway: "10.244.0.1"},
+			{Destination: "10.96.0.0/12", Gateway: "10.244.0.1", Metric: 100},
+			{Destination: "192.168.0.0/16", Gateway: "10.244.0.254"},
+		}},
+		{name: "skipped default route", ic: InterfaceConfiguration{SkipDefaultRoute: true}, expected: []cni.Routes{}},
+		{name: "secondary bridged interface", interfaceName: "net1", expected: []cni.Routes{}},
+		{name: "secondary routed interface", ic: InterfaceConfiguration{Mode: RoutedMode}, interfaceName: "net1", expected: []cni.Routes{{Destination: "10.244.0.0/24", Gateway: "10.244.0.1"}}},
+		{name: "network gateway outside of a later block", network: blockNetwork, ic: InterfaceConfiguration{Routes: []cni.Routes{{Destination: "10.96.0.0/12", Gateway: "10.244.0.1"}}}, expected: []cni.Routes{
+			{Destination: "0.0.0.0/0", Gateway: "10.244.0.1"},
+			{Destination: "10.96.0.0/12", Gateway: "10.244.0.1"},
+		}},
+		{name: "bad dst", ic: InterfaceConfiguration{Routes: []cni.Routes{{Destination: "10.96.0.0"}}}, err: "invalid route destination [10.96.0.0]"},
+		{name: "bad gw", ic: InterfaceConfiguration{Routes: []cni.Routes{{Destination: "10.96.0.0/12", Gateway: "10.244.0"}}}, err: "invalid gateway [10.244.0]"},
+		{name: "gw outside of the pod network", ic: InterfaceConfiguration{Routes: []cni.Routes{{Destination: "10.96.0.0/12", Gateway: "10.0.0.1"}}}, err: "gateway [10.0.0.1] for route [10.96.0.0/12] is not reachable from [10.244.0.0/24]"},
+	} {
+		im := newTestInterfaceManager(t, test.ic, &FakeDriver{})
+		ctx := newTestAttachmentContext()
+		if test.interfaceName != "" {
+			ctx.InterfaceName = test.interfaceName
+		}
+		network := podNetwork
+		if test.network != nil {
+			network = test.network
+		}
+
+		routes, err := im.containerRoutes(ctx, network, podGateway)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected [%s], got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(routes, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v (%v)", test.name, test.expected, routes, err)
+		}
+	}
+}
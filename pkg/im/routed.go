@@ -0,0 +1,48 @@
+package im
+
+import (
+	"fmt"
+	"net"
+	"yarp-cni/pkg/sysctl"
+
+	"github.com/vishvananda/netlink"
+)
+
+// routedGatewayIp is the link-local gateway every pod sees in routed mode.
+// It never exists on the host, the host veth answers for it through static ARP and proxy ARP.
+var routedGatewayIp = net.IPv4(169, 254, 1, 1).To4()
+
+// configureRoutedHostInterface lets the host veth answer ARP requests for the gateway
+func configureRoutedHostInterface(hostLink netlink.Link) error {
+	return sysctl.Set(fmt.Sprintf("net/ipv4/conf/%s/proxy_arp", hostLink.Attrs().Name), "1")
+}
+
+// configureRoutedGateway makes the link-local gateway reachable, pinned to the host veth MAC.
+// Must be called from within the container network namespace.
+func configureRoutedGateway(containerLink netlink.Link, hostMac net.HardwareAddr) error {
+	err := netlink.NeighAdd(&netlink.Neigh{
+		LinkIndex:    containerLink.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		IP:           routedGatewayIp,
+		HardwareAddr: hostMac,
+	})
+	if err != nil {
+		return err
+	}
+
+	return netlink.RouteAdd(&netlink.Route{
+		LinkIndex: containerLink.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       &net.IPNet{IP: routedGatewayIp, Mask: net.CIDRMask(32, 32)},
+	})
+}
+
+// addRoutedHostRoute sends the traffic for the pod ip down its host veth. The route goes away with the veth.
+func addRoutedHostRoute(hostLink netlink.Link, podIp net.IP) error {
+	return netlink.RouteAdd(&netlink.Route{
+		LinkIndex: hostLink.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       &net.IPNet{IP: podIp, Mask: net.CIDRMask(32, 32)},
+	})
+}
@@ -0,0 +1,133 @@
+package im
+
+import (
+	"fmt"
+	"yarp-cni/pkg/cni"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+var macvlanModes = map[string]netlink.MacvlanMode{
+	"":        netlink.MACVLAN_MODE_BRIDGE,
+	"bridge":  netlink.MACVLAN_MODE_BRIDGE,
+	"private": netlink.MACVLAN_MODE_PRIVATE,
+	"vepa":    netlink.MACVLAN_MODE_VEPA,
+}
+
+var ipvlanModes = map[string]netlink.IPVlanMode{
+	"":   netlink.IPVLAN_MODE_L2,
+	"l2": netlink.IPVLAN_MODE_L2,
+	"l3": netlink.IPVLAN_MODE_L3,
+}
+
+// SubInterfaceDriver attaches the pod straight to the master interface with a macvlan or ipvlan link.
+// There is no host side, so neither the bridge nor host port mappings or bandwidth limits are involved.
+type SubInterfaceDriver struct {
+	Manager *InterfaceManager
+}
+
+func (driver *SubInterfaceDriver) Add(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	im := driver.Manager
+	if len(ctx.RuntimeConfig.PortMappings) > 0 || ctx.RuntimeConfig.Bandwidth != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  fmt.Sprintf("port mappings and bandwidth limits are not supported in [%s] mode", im.Configuration.Mode),
+			Details:  "unsupported runtime config",
+		}
+	}
+
+	// Pod traffic never crosses the host forward chain, so there is nowhere to enforce isolation
+	if len(ctx.AllowedSources) > 0 {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  fmt.Sprintf("allowed sources are not supported in [%s] mode", im.Configuration.Mode),
+			Details:  "pod isolation is not enforceable",
+		}
+	}
+
+	master, err := netlink.LinkByName(im.Configuration.Master)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to fetch master link [%s]", im.Configuration.Master),
+		}
+	}
+
+	networkNsHandle, err := netns.GetFromPath(ctx.NetworkNamespace)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to load network namespace [%s]", ctx.NetworkNamespace),
+		}
+	}
+
+	// Created straight in the target namespace, like the container end of the veth
+	containerInterfaceAttrs := netlink.NewLinkAttrs()
+	containerInterfaceAttrs.Namespace = netlink.NsFd(networkNsHandle)
+	containerInterfaceAttrs.Name = ctx.InterfaceName
+	containerInterfaceAttrs.ParentIndex = master.Attrs().Index
+	containerInterfaceAttrs.MTU = im.Configuration.Mtu
+
+	subInterface, err := driver.subInterface(containerInterfaceAttrs)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("invalid [%s] configuration", im.Configuration.Mode),
+		}
+	}
+
+	err = netlink.LinkAdd(subInterface)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to add [%s] link [%s] on [%s]", im.Configuration.Mode, ctx.InterfaceName, im.Configuration.Master),
+		}
+	}
+
+	return im.runInNetworkNamespace(
+		networkNsHandle,
+		func() (*cni.ResultSuccess, *cni.ResultError) {
+			result, _, cniErr := im.configureContainerInterface(ctx, nil)
+			return result, cniErr
+		})
+}
+
+func (driver *SubInterfaceDriver) Check(ctx *AttachmentContext) *cni.ResultError {
+	im := driver.Manager
+	_, err := netlink.LinkByName(im.Configuration.Master)
+	if err != nil {
+		return &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to fetch master link [%s]", im.Configuration.Master),
+		}
+	}
+
+	return im.checkContainerInterface(ctx)
+}
+
+func (driver *SubInterfaceDriver) Del(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	return driver.Manager.deleteContainerInterface(ctx)
+}
+
+func (driver *SubInterfaceDriver) subInterface(attrs netlink.LinkAttrs) (netlink.Link, error) {
+	im := driver.Manager
+	if im.Configuration.Mode == IpvlanMode {
+		mode, ok := ipvlanModes[im.Configuration.IpvlanMode]
+		if !ok {
+			return nil, fmt.Errorf("unknown ipvlan mode [%s]", im.Configuration.IpvlanMode)
+		}
+		return &netlink.IPVlan{LinkAttrs: attrs, Mode: mode}, nil
+	}
+
+	mode, ok := macvlanModes[im.Configuration.MacvlanMode]
+	if !ok {
+		return nil, fmt.Errorf("unknown macvlan mode [%s]", im.Configuration.MacvlanMode)
+	}
+	return &netlink.Macvlan{LinkAttrs: attrs, Mode: mode}, nil
+}
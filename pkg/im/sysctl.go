@@ -0,0 +1,128 @@
+package im
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"yarp-cni/pkg/sysctl"
+)
+
+// SysctlError lists every sysctl that could not be applied
+type SysctlError struct {
+	Failed map[string]error
+}
+
+func (e *SysctlError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failures := make([]string, 0, len(names))
+	for _, name := range names {
+		failures = append(failures, fmt.Sprintf("%s: %s", name, e.Failed[name]))
+	}
+
+	return fmt.Sprintf("unable to set sysctls [%s]", strings.Join(failures, ", "))
+}
+
+// defaultHostSysctls are needed for pods to leave the node and for kube-proxy rules to see bridged traffic
+func (im *InterfaceManager) defaultHostSysctls() map[string]string {
+	if im.Configuration.Mode == RoutedMode {
+		return map[string]string{
+			"net.ipv4.ip_forward": "1",
+		}
+	}
+
+	return map[string]string{
+		"net.ipv4.ip_forward":                             "1",
+		"net.bridge.bridge-nf-call-iptables":              "1",
+		"net/ipv4/conf/" + im.bridgeName() + "/rp_filter": "2",
+	}
+}
+
+// applyHostSysctls sets the default host sysctls overridden by the configured ones. Only a default the host
+// does not have (e.g. br_netfilter not being loaded) is skipped with a warning, any other failure is returned.
+func (im *InterfaceManager) applyHostSysctls() error {
+	defaults := im.defaultHostSysctls()
+	sysctls := map[string]string{}
+	for name, value := range defaults {
+		sysctls[name] = value
+	}
+	for name, value := range im.Configuration.HostSysctls {
+		sysctls[name] = value
+		delete(defaults, name)
+	}
+
+	err := applySysctls(sysctls)
+	sysctlErr, ok := err.(*SysctlError)
+	if !ok {
+		return err
+	}
+
+	for name, failure := range sysctlErr.Failed {
+		if _, isDefault := defaults[name]; isDefault && os.IsNotExist(failure) {
+			im.Log.Warn(fmt.Sprintf("Skipping sysctl [%s] missing on the host", name))
+			delete(sysctlErr.Failed, name)
+		}
+	}
+
+	if len(sysctlErr.Failed) > 0 {
+		return sysctlErr
+	}
+
+	return nil
+}
+
+// ifnamePlaceholder in a container sysctl name stands for the interface being attached, e.g. net.ipv4.conf.{ifname}.rp_filter
+const ifnamePlaceholder = "{ifname}"
+
+// containerSysctls merges the configured container sysctls with the ones requested by the pod, with
+// ifnamePlaceholder replaced by the interface name. Pod requests must match one of the allowed patterns
+// (e.g. net.ipv4.conf.*.accept_redirects).
+func (im *InterfaceManager) containerSysctls(interfaceName string, podSysctls map[string]string) (map[string]string, error) {
+	sysctls := map[string]string{}
+	for name, value := range im.Configuration.ContainerSysctls {
+		sysctls[strings.ReplaceAll(name, ifnamePlaceholder, interfaceName)] = value
+	}
+
+	for name, value := range podSysctls {
+		name = strings.ReplaceAll(name, ifnamePlaceholder, interfaceName)
+		if !im.isPodSysctlAllowed(name) {
+			return nil, fmt.Errorf("sysctl [%s] is not allowed to be set by pods", name)
+		}
+		sysctls[name] = value
+	}
+
+	return sysctls, nil
+}
+
+func (im *InterfaceManager) isPodSysctlAllowed(name string) bool {
+	for _, pattern := range im.Configuration.AllowedPodSysctls {
+		matched, err := path.Match(pattern, name)
+		if err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func applySysctls(sysctls map[string]string) error {
+	sysctlErr := &SysctlError{Failed: map[string]error{}}
+	for name, value := range sysctls {
+		err := sysctl.Set(name, value)
+		if err != nil {
+			sysctlErr.Failed[name] = err
+		}
+	}
+
+	if len(sysctlErr.Failed) > 0 {
+		return sysctlErr
+	}
+
+	return nil
+}
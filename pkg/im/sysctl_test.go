@@ -0,0 +1,54 @@
+package im
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestContainerSysctls(t *testing.T) {
+	im := newTestInterfaceManager(t, InterfaceConfiguration{
+		ContainerSysctls:  map[string]string{"net.ipv4.conf.{ifname}.rp_filter": "2", "net.ipv4.conf.all.forwarding": "0"},
+		AllowedPodSysctls: []string{"net.ipv4.conf.*.accept_redirects", "net.ipv4.ping_group_range"},
+	}, &FakeDriver{})
+
+	for _, test := range []struct {
+		name       string
+		podSysctls map[string]string
+		expected   map[string]string
+		err        string
+	}{
+		{name: "configured only", expected: map[string]string{"net.ipv4.conf.net1.rp_filter": "2", "net.ipv4.conf.all.forwarding": "0"}},
+		{name: "allowed pod sysctls", podSysctls: map[string]string{"net.ipv4.conf.{ifname}.accept_redirects": "0", "net.ipv4.ping_group_range": "0 0"}, expected: map[string]string{
+			"net.ipv4.conf.net1.rp_filter": "2", "net.ipv4.conf.all.forwarding": "0", "net.ipv4.conf.net1.accept_redirects": "0", "net.ipv4.ping_group_range": "0 0",
+		}},
+		{name: "pod overriding a configured one", podSysctls: map[string]string{"net.ipv4.conf.all.accept_redirects": "1"}, expected: map[string]string{
+			"net.ipv4.conf.net1.rp_filter": "2", "net.ipv4.conf.all.forwarding": "0", "net.ipv4.conf.all.accept_redirects": "1",
+		}},
+		{name: "unknown pod sysctl", podSysctls: map[string]string{"net.ipv4.ip_forward": "1"}, err: "sysctl [net.ipv4.ip_forward] is not allowed"},
+		{name: "pattern does not cross a slash", podSysctls: map[string]string{"net/ipv4/conf/eth0/accept_redirects": "1"}, err: "is not allowed"},
+	} {
+		sysctls, err := im.containerSysctls("net1", test.podSysctls)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected [%s], got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(sysctls, test.expected) {
+			t.Errorf("%s: expected %v, got %v (%v)", test.name, test.expected, sysctls, err)
+		}
+	}
+}
+
+func TestApplySysctlsReportsEveryFailure(t *testing.T) {
+	err := applySysctls(map[string]string{"net.ipv4.yarp_unknown": "1", "net/../../etc/hostname": "pod"})
+	sysctlErr, ok := err.(*SysctlError)
+	if !ok || len(sysctlErr.Failed) != 2 {
+		t.Fatalf("expected both sysctls to be reported, got %v", err)
+	}
+	if !os.IsNotExist(sysctlErr.Failed["net.ipv4.yarp_unknown"]) {
+		t.Fatalf("expected an unknown sysctl to be reported as missing, got %v", sysctlErr.Failed["net.ipv4.yarp_unknown"])
+	}
+}
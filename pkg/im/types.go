@@ -1,8 +1,121 @@
 package im
 
+import (
+	"net"
+	"yarp-cni/pkg/cni"
+	"yarp-cni/pkg/state"
+)
+
+// maxInterfaceNameLength is IFNAMSIZ minus the trailing NUL
+const maxInterfaceNameLength = 15
+const minInterfaceHashLength = 8
+const DefaultHostInterfacePrefix = "yarp"
+
+// PrimaryInterfaceName is the interface kubelet asks for, secondary networks get other names (net1, net2, ...)
+const PrimaryInterfaceName = "eth0"
+
+// IptablesBackend, the default, shells out to iptables for host ports, NftablesBackend owns a table of its own
+const IptablesBackend = "iptables"
+const NftablesBackend = "nftables"
+
+// KernelDatapath leaves forwarding to the kernel, EbpfDatapath short-circuits it between local pods
+const KernelDatapath = ""
+const EbpfDatapath = "ebpf"
+
+const BridgeMode = "bridge"
+const RoutedMode = "routed"
+const MacvlanMode = "macvlan"
+const IpvlanMode = "ipvlan"
+
 type InterfaceConfiguration struct {
-	BridgeName string
+	NetworkName         string
+	StateDir            string
+	Routes              []cni.Routes
+	SkipDefaultRoute    bool
+	Mode                string
+	Datapath            string
+	FirewallBackend     string
+	Master              string
+	Vlan                int
+	MacvlanMode         string
+	IpvlanMode          string
+	BridgeName          string
+	Mtu                 int
+	HairpinMode         bool
+	PromiscMode         bool
+	HostInterfacePrefix string
+	HostSysctls         map[string]string
+	ContainerSysctls    map[string]string
+	AllowedPodSysctls   []string
+}
+
+// AttachmentContext holds everything known about a single ADD, CHECK or DEL of a pod interface
+type AttachmentContext struct {
+	ContainerId      string
+	NetworkNamespace string
+	InterfaceName    string
+	RequestedIp      net.IP
+	PodSysctls       map[string]string
+	RuntimeConfig    cni.RuntimeConfig
+	PrevResult       *cni.ResultSuccess
+
+	// ContainerSysctls is filled by the InterfaceManager from the configuration and PodSysctls
+	ContainerSysctls map[string]string
+	// AllowedSources isolates the pod to these CIDRs, with the nftables backend
+	AllowedSources []string
+	// State is what the InterfaceManager recorded at ADD, loaded on CHECK and DEL
+	State *state.Attachment
+}
+
+// AttachmentDriver implements one data path to plug pods into the node network
+type AttachmentDriver interface {
+	Add(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError)
+	Check(ctx *AttachmentContext) *cni.ResultError
+	Del(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError)
 }
 
-type ContainerNetworkClient interface {
+var attachmentDrivers = map[string]func(*InterfaceManager) AttachmentDriver{
+	"":          func(im *InterfaceManager) AttachmentDriver { return &VethDriver{Manager: im} },
+	BridgeMode:  func(im *InterfaceManager) AttachmentDriver { return &VethDriver{Manager: im} },
+	RoutedMode:  func(im *InterfaceManager) AttachmentDriver { return &VethDriver{Manager: im} },
+	MacvlanMode: func(im *InterfaceManager) AttachmentDriver { return &SubInterfaceDriver{Manager: im} },
+	IpvlanMode:  func(im *InterfaceManager) AttachmentDriver { return &SubInterfaceDriver{Manager: im} },
+}
+
+// key identifies the attachment among all the interfaces of the pod
+func (ctx *AttachmentContext) key() string {
+	return ctx.ContainerId + "/" + ctx.InterfaceName
+}
+
+// isPrimary tells whether the attachment is the main pod interface, the only one to get the default route
+func (ctx *AttachmentContext) isPrimary() bool {
+	return ctx.InterfaceName == PrimaryInterfaceName
+}
+
+// expectedIps lists the addresses prevResult reports for the interface of this attachment
+func (ctx *AttachmentContext) expectedIps() []*net.IPNet {
+	expected := []*net.IPNet{}
+	if ctx.PrevResult == nil {
+		return expected
+	}
+
+	for _, ip := range ctx.PrevResult.Ips {
+		if ip.Interface < 0 || ip.Interface >= len(ctx.PrevResult.Interfaces) {
+			continue
+		}
+
+		cniInterface := ctx.PrevResult.Interfaces[ip.Interface]
+		if cniInterface.Name != ctx.InterfaceName || cniInterface.NetworkNamespace != ctx.NetworkNamespace {
+			continue
+		}
+
+		address, ipNet, err := net.ParseCIDR(ip.Address)
+		if err != nil {
+			continue
+		}
+		ipNet.IP = address
+		expected = append(expected, ipNet)
+	}
+
+	return expected
 }
@@ -0,0 +1,339 @@
+package im
+
+import (
+	"fmt"
+	"net"
+	"yarp-cni/pkg/cni"
+	"yarp-cni/pkg/nft"
+	"yarp-cni/pkg/sysctl"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// VethDriver plugs pods through a veth pair, the host end being enslaved to the bridge or, in routed mode,
+// routed to directly
+type VethDriver struct {
+	Manager *InterfaceManager
+}
+
+// bridgeNfCallIptables hands bridged traffic to the ip hooks, and so to the forward chain of the yarp table
+const bridgeNfCallIptables = "net/bridge/bridge-nf-call-iptables"
+
+func (driver *VethDriver) Add(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	im := driver.Manager
+
+	err := driver.checkIsolation(ctx)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  "pod isolation is not enforceable",
+		}
+	}
+
+	var bridge *netlink.Bridge
+	if im.Configuration.Mode == RoutedMode {
+		err = im.applyHostSysctls()
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  "unable to apply host sysctls",
+			}
+		}
+	} else {
+		bridge, err = im.ensureBridgeIsPresent()
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to ensure bridge [%s]", im.bridgeName()),
+			}
+		}
+	}
+
+	networkNsHandle, err := netns.GetFromPath(ctx.NetworkNamespace)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to load network namespace [%s]", ctx.NetworkNamespace),
+		}
+	}
+
+	hostVirtualInterfaceName, err := im.hostVirtualInterfaceName(ctx.ContainerId, ctx.InterfaceName)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  "unable to name host veth",
+		}
+	}
+
+	err = im.removeStaleLinks(hostVirtualInterfaceName)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to remove stale link [%s]", hostVirtualInterfaceName),
+		}
+	}
+
+	// The container end is created straight in the target namespace while the peer stays in ours,
+	// so CNI_IFNAME never shows up in the host namespace where it could collide with e.g. the host eth0
+	containerVirtualInterfaceAttrs := netlink.NewLinkAttrs()
+	containerVirtualInterfaceAttrs.Namespace = netlink.NsFd(networkNsHandle)
+	containerVirtualInterfaceAttrs.Name = ctx.InterfaceName
+	containerVirtualInterfaceAttrs.MTU = im.Configuration.Mtu
+
+	virtualLinkInterface := &netlink.Veth{
+		LinkAttrs: containerVirtualInterfaceAttrs,
+		PeerName:  hostVirtualInterfaceName,
+	}
+	err = netlink.LinkAdd(virtualLinkInterface)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to add paired veth [%s<->%s]", hostVirtualInterfaceName, ctx.InterfaceName),
+		}
+	}
+
+	hostLink, err := netlink.LinkByName(hostVirtualInterfaceName)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to fetch link [%s]", hostVirtualInterfaceName),
+		}
+	}
+
+	if im.Configuration.Mode == RoutedMode {
+		err = configureRoutedHostInterface(hostLink)
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to enable proxy arp on [%s]", hostVirtualInterfaceName),
+			}
+		}
+	} else {
+		err = netlink.LinkSetMaster(hostLink, bridge)
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to link [%s] to bridge [%s]", hostVirtualInterfaceName, im.bridgeName()),
+			}
+		}
+
+		// Lets a pod reach itself through a Service ClusterIP, as expected by kubelet's --hairpin-mode=hairpin-veth
+		if im.Configuration.HairpinMode {
+			err = netlink.LinkSetHairpin(hostLink, true)
+			if err != nil {
+				return nil, &cni.ResultError{
+					ExitCode: 1,
+					Message:  err.Error(),
+					Details:  fmt.Sprintf("unable to enable hairpin mode on [%s]", hostVirtualInterfaceName),
+				}
+			}
+		}
+	}
+
+	err = netlink.LinkSetUp(hostLink)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to enable link [%s]", hostVirtualInterfaceName),
+		}
+	}
+
+	if ctx.RuntimeConfig.Bandwidth != nil {
+		err = im.applyBandwidthLimits(hostLink, ctx.RuntimeConfig.Bandwidth)
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to apply bandwidth limits to [%s]", hostVirtualInterfaceName),
+			}
+		}
+	}
+
+	var podAddress *net.IPNet
+	result, cniErr := im.runInNetworkNamespace(
+		networkNsHandle,
+		func() (*cni.ResultSuccess, *cni.ResultError) {
+			result, address, cniErr := im.configureContainerInterface(ctx, hostLink)
+			podAddress = address
+			return result, cniErr
+		})
+
+	if cniErr != nil {
+		return nil, cniErr
+	}
+	podIp := podAddress.IP
+
+	// Pods are reached through the bridge, or in routed mode through their own host veth
+	podReachableThrough := im.bridgeName()
+	if im.Configuration.Mode == RoutedMode {
+		podReachableThrough = hostVirtualInterfaceName
+		err = addRoutedHostRoute(hostLink, podIp)
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to route [%s] through [%s]", podIp, hostVirtualInterfaceName),
+			}
+		}
+	}
+
+	if im.Configuration.Datapath == EbpfDatapath {
+		err = im.attachEbpfDatapath(hostLink, podIp)
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to attach eBPF datapath to [%s]", hostVirtualInterfaceName),
+			}
+		}
+	}
+
+	if im.Configuration.FirewallBackend == NftablesBackend {
+		err = im.Nft.AddEndpoint(ctx.key(), podReachableThrough, &nft.Endpoint{
+			PodIp:          podIp.String(),
+			PodSubnet:      podNetwork(podAddress).String(),
+			PortMappings:   ctx.RuntimeConfig.PortMappings,
+			AllowedSources: ctx.AllowedSources,
+		})
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to program nftables for [%s]", podIp),
+			}
+		}
+	} else if len(ctx.RuntimeConfig.PortMappings) > 0 {
+		err = im.PortMapper.AddMappings(ctx.key(), podIp, podReachableThrough, ctx.RuntimeConfig.PortMappings)
+		if err != nil {
+			return nil, &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to map host ports to [%s]", podIp),
+			}
+		}
+	}
+
+	// The host side lives in the host namespace, so it carries no sandbox
+	cniResponse := cni.ResultSuccess{
+		Interfaces: []cni.Interface{
+			{
+				Name: hostVirtualInterfaceName,
+				Mac:  hostLink.Attrs().HardwareAddr.String(),
+			},
+		},
+	}
+
+	cniResponse.Append(result)
+	return &cniResponse, nil
+}
+
+func (driver *VethDriver) Check(ctx *AttachmentContext) *cni.ResultError {
+	im := driver.Manager
+	hostVirtualInterfaceName, err := im.hostVirtualInterfaceName(ctx.ContainerId, ctx.InterfaceName)
+	if err != nil {
+		return &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  "unable to name host veth",
+		}
+	}
+
+	hostLink, err := netlink.LinkByName(hostVirtualInterfaceName)
+	if err != nil {
+		return &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  fmt.Sprintf("unable to fetch link [%s]", hostVirtualInterfaceName),
+		}
+	}
+
+	if hostLink.Attrs().Flags&net.FlagUp == 0 {
+		return &cni.ResultError{
+			ExitCode: 1,
+			Message:  fmt.Sprintf("link [%s] is down", hostVirtualInterfaceName),
+			Details:  "host veth is not up",
+		}
+	}
+
+	if im.Configuration.Mode != RoutedMode {
+		bridge, err := netlink.LinkByName(im.bridgeName())
+		if err != nil {
+			return &cni.ResultError{
+				ExitCode: 1,
+				Message:  err.Error(),
+				Details:  fmt.Sprintf("unable to fetch link [%s]", im.bridgeName()),
+			}
+		}
+
+		if hostLink.Attrs().MasterIndex != bridge.Attrs().Index {
+			return &cni.ResultError{
+				ExitCode: 1,
+				Message:  fmt.Sprintf("link [%s] is not attached to bridge [%s]", hostVirtualInterfaceName, im.bridgeName()),
+				Details:  "host veth is detached",
+			}
+		}
+	}
+
+	return im.checkContainerInterface(ctx)
+}
+
+func (driver *VethDriver) Del(ctx *AttachmentContext) (*cni.ResultSuccess, *cni.ResultError) {
+	im := driver.Manager
+	hostVirtualInterfaceName, err := im.hostVirtualInterfaceName(ctx.ContainerId, ctx.InterfaceName)
+	if err != nil {
+		return nil, &cni.ResultError{
+			ExitCode: 1,
+			Message:  err.Error(),
+			Details:  "unable to name host veth",
+		}
+	}
+
+	err = im.removeBandwidthLimits(hostVirtualInterfaceName)
+	if err != nil {
+		im.Log.Warn(fmt.Sprintf("unable to delete bandwidth limits of container [%s]: %s", ctx.ContainerId, err))
+	}
+
+	if im.Configuration.Datapath == EbpfDatapath && ctx.State != nil {
+		err = im.detachEbpfDatapath(ctx.State.Ips)
+		if err != nil {
+			im.Log.Warn(fmt.Sprintf("unable to forget eBPF endpoints of container [%s]: %s", ctx.ContainerId, err))
+		}
+	}
+
+	// Deleting the container end takes the host end, and its routes, along
+	return im.deleteContainerInterface(ctx)
+}
+
+// checkIsolation refuses allowed sources the forward chain would not see: pod to pod traffic on the bridge
+// without br_netfilter, or redirected from veth to veth by the eBPF datapath
+func (driver *VethDriver) checkIsolation(ctx *AttachmentContext) error {
+	im := driver.Manager
+	if len(ctx.AllowedSources) == 0 {
+		return nil
+	}
+
+	if im.Configuration.Datapath == EbpfDatapath {
+		return fmt.Errorf("datapath [%s] forwards between pods past the isolation rules", EbpfDatapath)
+	}
+
+	if im.Configuration.Mode != RoutedMode {
+		value, err := sysctl.Get(bridgeNfCallIptables)
+		if err != nil || value != "1" {
+			return fmt.Errorf("isolation on bridge [%s] requires the br_netfilter module with [%s] set to 1", im.bridgeName(), bridgeNfCallIptables)
+		}
+	}
+
+	return nil
+}
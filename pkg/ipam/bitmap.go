@@ -0,0 +1,126 @@
+package ipam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+)
+
+// minRangePrefix bounds a range to 64K addresses, an 8KB bitmap read and written back on every change
+const minRangePrefix = 16
+
+// ipRange tracks the allocations of one range with a bit per address, the network address being bit 0.
+// Cursor is the offset of the last allocation: the next one starts right after it, so a released ip
+// is only handed out again once the whole range went round.
+type ipRange struct {
+	Network *net.IPNet
+	Bitmap  []byte
+	Cursor  uint32
+}
+
+func newIpRange(network *net.IPNet) (*ipRange, error) {
+	ones, size := network.Mask.Size()
+	if size != 32 || ones > 30 {
+		return nil, fmt.Errorf("range [%s] is not an ipv4 network with usable addresses", network)
+	}
+	if ones < minRangePrefix {
+		return nil, fmt.Errorf("range [%s] is larger than a /%d", network, minRangePrefix)
+	}
+
+	return &ipRange{
+		Network: &net.IPNet{IP: network.IP.Mask(network.Mask).To4(), Mask: network.Mask},
+		Bitmap:  make([]byte, (rangeSize(network)+7)/8),
+	}, nil
+}
+
+// rangeSize is computed on 64 bits, a /0 would overflow 32
+func rangeSize(network *net.IPNet) uint64 {
+	ones, size := network.Mask.Size()
+	return 1 << uint(size-ones)
+}
+
+// size fits 32 bits, newIpRange refusing ranges larger than a /minRangePrefix
+func (r *ipRange) size() uint32 {
+	return uint32(rangeSize(r.Network))
+}
+
+// offset returns the position of ip in the range, or false if it is the network, the broadcast or not in it
+func (r *ipRange) offset(ip net.IP) (uint32, bool) {
+	ip = ip.To4()
+	if ip == nil || !r.Network.Contains(ip) {
+		return 0, false
+	}
+
+	offset := binary.BigEndian.Uint32(ip) - binary.BigEndian.Uint32(r.Network.IP)
+	if offset == 0 || offset == r.size()-1 {
+		return 0, false
+	}
+
+	return offset, true
+}
+
+func (r *ipRange) ip(offset uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(r.Network.IP)+offset)
+	return ip
+}
+
+func (r *ipRange) isSet(offset uint32) bool {
+	return r.Bitmap[offset/8]&(0x80>>(offset%8)) != 0
+}
+
+func (r *ipRange) set(offset uint32) {
+	r.Bitmap[offset/8] |= 0x80 >> (offset % 8)
+}
+
+func (r *ipRange) clear(offset uint32) {
+	r.Bitmap[offset/8] &^= 0x80 >> (offset % 8)
+}
+
+// allocated counts the allocated addresses
+func (r *ipRange) allocated() int {
+	count := 0
+	for _, b := range r.Bitmap {
+		count += bits.OnesCount8(b)
+	}
+
+	return count
+}
+
+func (r *ipRange) free() int {
+	return int(r.size()) - 2 - r.allocated()
+}
+
+// nextFree looks for a free address from the cursor on, wrapping around at the end of the range.
+// It is linear in the size of the range at worst, full bytes being skipped whole: with the cursor moving on,
+// it stops after a few bits as long as the range is not mostly full.
+func (r *ipRange) nextFree(from uint32) (uint32, bool) {
+	size := r.size()
+	for scanned := uint32(0); scanned < size; {
+		offset := (from + scanned) % size
+		if offset%8 == 0 && r.Bitmap[offset/8] == 0xff && scanned+8 <= size {
+			scanned += 8
+			continue
+		}
+
+		if offset != 0 && offset != size-1 && !r.isSet(offset) {
+			return offset, true
+		}
+		scanned++
+	}
+
+	return 0, false
+}
+
+// allocate takes the first free address after the cursor
+func (r *ipRange) allocate() (net.IP, bool) {
+	offset, ok := r.nextFree(r.Cursor + 1)
+	if !ok {
+		return nil, false
+	}
+
+	r.set(offset)
+	r.Cursor = offset
+	return r.ip(offset), true
+}
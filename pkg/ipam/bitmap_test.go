@@ -0,0 +1,401 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func mustParseCidr(t testing.TB, cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return network
+}
+
+func mustNewIpRange(t testing.TB, cidr string) *ipRange {
+	r, err := newIpRange(mustParseCidr(t, cidr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestNewIpRangeBounds(t *testing.T) {
+	for _, test := range []struct {
+		cidr  string
+		valid bool
+		size  uint32
+	}{
+		{cidr: "0.0.0.0/0"},
+		{cidr: "10.0.0.0/1"},
+		{cidr: "10.0.0.0/15"},
+		{cidr: "10.0.0.0/16", valid: true, size: 1 << 16},
+		{cidr: "10.0.0.0/30", valid: true, size: 4},
+		{cidr: "10.0.0.0/31"},
+		{cidr: "fd00::/120"},
+	} {
+		r, err := newIpRange(mustParseCidr(t, test.cidr))
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected the range to be refused", test.cidr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", test.cidr, err)
+			continue
+		}
+		if r.size() != test.size || len(r.Bitmap) != int(test.size+7)/8 {
+			t.Errorf("%s: expected %d addresses, got %d in %d bytes", test.cidr, test.size, r.size(), len(r.Bitmap))
+		}
+	}
+}
+
+func TestNextFreeWrapsAround(t *testing.T) {
+	r := mustNewIpRange(t, "10.0.0.0/29")
+	r.set(5)
+	r.set(6)
+
+	// From the end of the range, the search wraps to the start and skips the network address
+	offset, ok := r.nextFree(5)
+	if !ok || offset != 1 {
+		t.Fatalf("expected offset 1, got %d (%t)", offset, ok)
+	}
+
+	offset, ok = r.nextFree(3)
+	if !ok || offset != 3 {
+		t.Fatalf("expected offset 3, got %d (%t)", offset, ok)
+	}
+}
+
+func TestNextFreeSkipsFullBytes(t *testing.T) {
+	r := mustNewIpRange(t, "10.0.0.0/24")
+	for offset := uint32(1); offset < 200; offset++ {
+		r.set(offset)
+	}
+
+	offset, ok := r.nextFree(1)
+	if !ok || offset != 200 {
+		t.Fatalf("expected offset 200, got %d (%t)", offset, ok)
+	}
+
+	// The broadcast address is never handed out, so the search wraps past it
+	for offset := uint32(200); offset < 255; offset++ {
+		r.set(offset)
+	}
+	r.clear(42)
+	offset, ok = r.nextFree(250)
+	if !ok || offset != 42 {
+		t.Fatalf("expected offset 42, got %d (%t)", offset, ok)
+	}
+}
+
+func TestNextFreeOnFullRange(t *testing.T) {
+	r := mustNewIpRange(t, "10.0.0.0/28")
+	for offset := uint32(1); offset < 15; offset++ {
+		r.set(offset)
+	}
+
+	_, ok := r.nextFree(1)
+	if ok {
+		t.Fatal("expected a full range")
+	}
+	if r.free() != 0 {
+		t.Fatalf("expected no free address, got %d", r.free())
+	}
+}
+
+func TestAllocateIsRoundRobin(t *testing.T) {
+	r := mustNewIpRange(t, "10.0.0.0/29")
+
+	allocated := []string{}
+	for i := 0; i < 3; i++ {
+		ip, ok := r.allocate()
+		if !ok {
+			t.Fatal("expected a free address")
+		}
+		allocated = append(allocated, ip.String())
+	}
+
+	// A released address is only handed out once the rest of the range was
+	offset, _ := r.offset(net.ParseIP("10.0.0.2"))
+	r.clear(offset)
+	ip, _ := r.allocate()
+	allocated = append(allocated, ip.String())
+
+	expected := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	if !reflect.DeepEqual(allocated, expected) {
+		t.Fatalf("expected %v, got %v", expected, allocated)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	db := &localIpamDb{Gateway: net.ParseIP("10.244.1.1").To4()}
+	for _, cidr := range []string{"10.244.1.0/24", "10.244.2.0/26"} {
+		err := db.addRange(mustParseCidr(t, cidr))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Ranges[0].set(1)
+	db.Ranges[0].set(17)
+	db.Ranges[0].Cursor = 17
+	db.Ranges[1].set(62)
+	db.Ranges[1].Cursor = 62
+
+	content := db.marshal()
+	if len(content) != 4+1+4+2+(4+1+4+32)+(4+1+4+8) {
+		t.Fatalf("unexpected db size %d", len(content))
+	}
+
+	loaded, err := unmarshalLocalIpamDb(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(db, loaded) {
+		t.Fatalf("expected %+v, got %+v", db, loaded)
+	}
+}
+
+func TestUnmarshalRejectsCorruptDb(t *testing.T) {
+	db := &localIpamDb{}
+	err := db.addRange(mustParseCidr(t, "10.244.1.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := db.marshal()
+
+	for name, corrupt := range map[string][]byte{
+		"truncated": content[:len(content)-1],
+		"magic":     append([]byte("NOPE"), content[4:]...),
+		"version":   append(append([]byte{}, content[:4]...), append([]byte{2}, content[5:]...)...),
+	} {
+		_, err := unmarshalLocalIpamDb(corrupt)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMigrateLocalIpamDb(t *testing.T) {
+	legacy := []byte(`{"CIDR":"10.244.1.0/29","Blocks":["10.244.2.0/30"],"gateway":"10.244.1.1","AllocatedIps":["10.244.1.1","10.244.1.4","10.244.2.1","10.244.9.9"]}`)
+
+	db, err := unmarshalLocalIpamDb(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !db.Gateway.Equal(net.ParseIP("10.244.1.1")) {
+		t.Fatalf("unexpected gateway [%s]", db.Gateway)
+	}
+
+	networks := []string{}
+	for _, network := range db.networks() {
+		networks = append(networks, network.String())
+	}
+	if !reflect.DeepEqual(networks, []string{"10.244.1.0/29", "10.244.2.0/30"}) {
+		t.Fatalf("unexpected ranges %v", networks)
+	}
+
+	// Addresses outside every range are dropped, cursors sit on the highest allocation
+	if db.Ranges[0].allocated() != 2 || db.Ranges[1].allocated() != 1 {
+		t.Fatalf("unexpected allocations %d and %d", db.Ranges[0].allocated(), db.Ranges[1].allocated())
+	}
+	if db.Ranges[0].Cursor != 4 || db.Ranges[1].Cursor != 1 {
+		t.Fatalf("unexpected cursors %d and %d", db.Ranges[0].Cursor, db.Ranges[1].Cursor)
+	}
+
+	ip, ok := db.Ranges[0].allocate()
+	if !ok || ip.String() != "10.244.1.5" {
+		t.Fatalf("expected 10.244.1.5 after migration, got %s", ip)
+	}
+}
+
+func TestMigratedDbIsWrittenCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.db")
+	err := ioutil.WriteFile(path, []byte(`{"CIDR":"10.244.1.0/24","AllocatedIps":["10.244.1.1"]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewLocalIpamClient(logrus.New(), &LocalIpamClientConfig{IpamDbPath: path})
+	ip, _, err := client.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.244.1.2" {
+		t.Fatalf("expected 10.244.1.2, got %s", ip)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content[:4]) != string(localIpamDbMagic) {
+		t.Fatal("expected the db to be rewritten in the compact format")
+	}
+}
+
+// nextIpInCidr is the address walk of the former allocator
+func nextIpInCidr(ip net.IP, cidr net.IPNet) (net.IP, error) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+
+	if !cidr.Contains(ip) {
+		return ip, fmt.Errorf("next IP is over the CIDR range")
+	}
+
+	return ip, nil
+}
+
+// legacyJsonAllocate replays the former allocator: read the JSON db, walk the range checking every address against
+// the whole allocated list, then write the JSON back
+func legacyJsonAllocate(path string) (net.IP, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &LocalIpamConfigFile{}
+	err = json.Unmarshal(content, db)
+	if err != nil {
+		return nil, err
+	}
+
+	_, network, err := net.ParseCIDR(db.CIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, network.IP.To4())
+	for {
+		ip, err = nextIpInCidr(ip, *network)
+		if err != nil {
+			return nil, err
+		}
+
+		taken := false
+		for _, allocated := range db.AllocatedIps {
+			if allocated == ip.String() {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			break
+		}
+	}
+
+	db.AllocatedIps = append(db.AllocatedIps, ip.String())
+	content, err = json.Marshal(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return ip, ioutil.WriteFile(path, content, 0644)
+}
+
+func legacyJsonDeallocate(path string, ip net.IP) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	db := &LocalIpamConfigFile{}
+	err = json.Unmarshal(content, db)
+	if err != nil {
+		return err
+	}
+
+	for i, allocated := range db.AllocatedIps {
+		if allocated == ip.String() {
+			db.AllocatedIps = append(db.AllocatedIps[:i], db.AllocatedIps[i+1:]...)
+			break
+		}
+	}
+
+	content, err = json.Marshal(db)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// BenchmarkAllocate allocates then releases one address of a /16 which already holds benchmarkPreallocated pods
+func BenchmarkAllocate(b *testing.B) {
+	const benchmarkPreallocated = 4096
+
+	b.Run("bitmap", func(b *testing.B) {
+		logger := logrus.New()
+		logger.SetLevel(logrus.WarnLevel)
+		client := NewLocalIpamClient(logger, &LocalIpamClientConfig{
+			IpamDbPath: filepath.Join(b.TempDir(), "ipam.db"),
+			Subnet:     "10.0.0.0/16",
+		})
+		for i := 0; i < benchmarkPreallocated; i++ {
+			_, _, err := client.AllocateIpv4Address()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ip, _, err := client.AllocateIpv4Address()
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = client.DeAllocateIpv4Address(ip)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("json", func(b *testing.B) {
+		db := &LocalIpamConfigFile{CIDR: "10.0.0.0/16", AllocatedIps: []string{}}
+		ip := net.ParseIP("10.0.0.0").To4()
+		for i := 0; i < benchmarkPreallocated; i++ {
+			ip, _ = nextIpInCidr(ip, *mustParseCidr(b, db.CIDR))
+			db.AllocatedIps = append(db.AllocatedIps, ip.String())
+		}
+		content, err := json.Marshal(db)
+		if err != nil {
+			b.Fatal(err)
+		}
+		path := filepath.Join(b.TempDir(), "ipam.json")
+		err = ioutil.WriteFile(path, content, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ip, err := legacyJsonAllocate(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = legacyJsonDeallocate(path, ip)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,471 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+const DefaultPoolName = "default"
+
+// PoolError reports a pool that cannot serve the request whatever the retries, e.g. an exhausted one
+type PoolError struct {
+	Pool   string
+	Reason string
+}
+
+func (err *PoolError) Error() string {
+	return fmt.Sprintf("pool [%s] %s", err.Pool, err.Reason)
+}
+
+type CrdIpamClientConfig struct {
+	Pool          string
+	NodeName      string
+	PodNamespace  string
+	PodName       string
+	ContainerId   string
+	InterfaceName string
+}
+
+// CrdIpamClient allocates addresses from a YarpIPPool, giving a cluster wide view that outlives the nodes.
+// As with the etcd ipam, the pool is split in blocks each node claims for itself, with a gateway of its own,
+// so the router can route the addresses of a node as a few prefixes.
+// The pool only changes when a block is claimed: addresses are claimed by creating their YarpIPAllocation,
+// so the allocations of the nodes do not contend on the pool.
+type CrdIpamClient struct {
+	Config *CrdIpamClientConfig
+	Client dynamic.Interface
+	Log    *logrus.Logger
+}
+
+func NewCrdIpamClient(logger *logrus.Logger, client dynamic.Interface, config *CrdIpamClientConfig) *CrdIpamClient {
+	return &CrdIpamClient{
+		Config: config,
+		Client: client,
+		Log:    logger,
+	}
+}
+
+// GetGatewayAddress returns the gateway of the node along with the block it is in
+func (ipamManager *CrdIpamClient) GetGatewayAddress() (net.IP, *net.IPNet, error) {
+	pool, layout, err := ipamManager.loadPool()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if address, ok := pool.Spec.Gateways[ipamManager.Config.NodeName]; ok {
+		gateway := net.ParseIP(address).To4()
+		return gateway, &net.IPNet{IP: gateway, Mask: layout.blockOf(gateway).Mask}, nil
+	}
+
+	allocated, _, err := ipamManager.allocate(pool, layout, gatewayOwner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Another ADD on the node may have set the gateway meanwhile, the first one written wins
+	gateway := allocated
+	err = ipamManager.updatePool(func(pool *YarpIPPool, layout *blockPool) (bool, error) {
+		if address, ok := pool.Spec.Gateways[ipamManager.Config.NodeName]; ok {
+			gateway = net.ParseIP(address).To4()
+			return false, nil
+		}
+
+		gateway = allocated
+		if pool.Spec.Gateways == nil {
+			pool.Spec.Gateways = map[string]string{}
+		}
+		pool.Spec.Gateways[ipamManager.Config.NodeName] = gateway.String()
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !gateway.Equal(allocated) {
+		ipamManager.releaseAllocation(allocated)
+	}
+
+	return gateway, &net.IPNet{IP: gateway, Mask: layout.blockOf(gateway).Mask}, nil
+}
+
+func (ipamManager *CrdIpamClient) AllocateIpv4Address() (net.IP, *net.IPNet, error) {
+	pool, layout, err := ipamManager.loadPool()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ip, block, err := ipamManager.allocate(pool, layout, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ipamManager.Log.Debug(fmt.Sprintf("Allocated [%s] from block [%s] of pool [%s]", ip, block, ipamManager.Config.Pool))
+	return ip, block, nil
+}
+
+func (ipamManager *CrdIpamClient) AllocateStaticIpv4Address(requestedIp net.IP) (net.IP, *net.IPNet, error) {
+	pool, layout, err := ipamManager.loadPool()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Network and broadcast addresses, of the pool as of the block, are never handed out
+	ip := requestedIp.To4()
+	if ip == nil || !layout.cidr.Contains(ip) {
+		return nil, nil, fmt.Errorf("%w: [%s] is not usable in [%s]", ErrIpOutOfRange, requestedIp, pool.Spec.CIDR)
+	}
+	block := layout.blockOf(ip)
+	if ip.Equal(block.IP) || ip.Equal(broadcastAddress(*block)) || ip.Equal(broadcastAddress(*layout.cidr)) {
+		return nil, nil, fmt.Errorf("%w: [%s] is not usable in [%s]", ErrIpOutOfRange, requestedIp, block)
+	}
+
+	// The address must stay routed to this node, so it has to come from one of its blocks
+	err = ipamManager.updatePool(func(pool *YarpIPPool, layout *blockPool) (bool, error) {
+		owner, claimed := pool.Spec.Blocks[block.String()]
+		if claimed && owner != ipamManager.Config.NodeName {
+			return false, fmt.Errorf("%w: [%s] is in block [%s] of node [%s]", ErrIpOutOfRange, requestedIp, block, owner)
+		}
+		if claimed {
+			return false, nil
+		}
+
+		ipamManager.claimBlock(pool, block)
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	created, err := ipamManager.claimIp(ip, block, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !created {
+		return nil, nil, fmt.Errorf("%w: [%s]", ErrIpAlreadyAllocated, ip.String())
+	}
+
+	ipamManager.Log.Debug(fmt.Sprintf("Allocated static [%s] from pool [%s]", ip, ipamManager.Config.Pool))
+	return ip, block, nil
+}
+
+// DeAllocateIpv4Address deletes the YarpIPAllocation of the address, unless another node or container holds it
+func (ipamManager *CrdIpamClient) DeAllocateIpv4Address(ip net.IP) error {
+	address := ip.To4().String()
+	allocations := ipamManager.Client.Resource(ipAllocationResource)
+
+	object, err := allocations.Get(context.Background(), ipamManager.allocationName(ip), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	allocation := &YarpIPAllocation{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), allocation)
+	if err != nil {
+		return err
+	}
+	if !ipamManager.owns(&allocation.Spec) {
+		ipamManager.Log.Warn(fmt.Sprintf("Not releasing [%s], owned by [%+v]", address, allocation.Spec))
+		return nil
+	}
+
+	err = allocations.Delete(context.Background(), object.GetName(), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	ipamManager.Log.Debug(fmt.Sprintf("DeAllocated [%s] from pool [%s]", address, ipamManager.Config.Pool))
+	return nil
+}
+
+// DeAllocateAttachment deletes the YarpIPAllocations the interface of the container holds in the blocks of the node
+func (ipamManager *CrdIpamClient) DeAllocateAttachment(containerId string, interfaceName string) ([]net.IP, error) {
+	pool, layout, err := ipamManager.loadPool()
+	if err != nil {
+		return nil, err
+	}
+
+	allocations := ipamManager.Client.Resource(ipAllocationResource)
+	released := []net.IP{}
+	for _, block := range ipamManager.nodeBlocks(pool, layout) {
+		list, err := allocations.List(context.Background(), metav1.ListOptions{LabelSelector: ipamManager.blockSelector(block)})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range list.Items {
+			allocation := &YarpIPAllocation{}
+			err = runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), allocation)
+			if err != nil {
+				return nil, err
+			}
+			if allocation.Spec.Node != ipamManager.Config.NodeName || allocation.Spec.ContainerId != containerId || allocation.Spec.InterfaceName != interfaceName {
+				continue
+			}
+
+			err = allocations.Delete(context.Background(), item.GetName(), metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+			released = append(released, net.ParseIP(allocation.Spec.Ip).To4())
+		}
+	}
+
+	ipamManager.Log.Debug(fmt.Sprintf("DeAllocated %s of [%s/%s] from pool [%s]", released, containerId, interfaceName, ipamManager.Config.Pool))
+	return released, nil
+}
+
+// NodeBlocks lists the blocks of the pool by node, for the router to route them
+func (ipamManager *CrdIpamClient) NodeBlocks() (map[string][]*net.IPNet, error) {
+	pool, _, err := ipamManager.loadPool()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := map[string][]*net.IPNet{}
+	for cidr, node := range pool.Spec.Blocks {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: fmt.Sprintf("has an invalid block [%s]", cidr)}
+		}
+		blocks[node] = append(blocks[node], block)
+	}
+
+	return blocks, nil
+}
+
+// allocate claims the first free address of the blocks of the node, claiming a new block when they are full
+func (ipamManager *CrdIpamClient) allocate(pool *YarpIPPool, layout *blockPool, owner string) (net.IP, *net.IPNet, error) {
+	for _, block := range ipamManager.nodeBlocks(pool, layout) {
+		ip, err := ipamManager.allocateInBlock(layout, block, owner)
+		if err != nil || ip != nil {
+			return ip, block, err
+		}
+	}
+
+	// Static addresses may already fill an unclaimed block, the next one is then claimed
+	for {
+		block, err := ipamManager.claimFreeBlock()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ip, err := ipamManager.allocateInBlock(layout, block, owner)
+		if err != nil || ip != nil {
+			return ip, block, err
+		}
+	}
+}
+
+// allocateInBlock claims the first free address of the block, or returns nil when it is full.
+// An address another ADD claimed since the listing is skipped.
+func (ipamManager *CrdIpamClient) allocateInBlock(layout *blockPool, block *net.IPNet, owner string) (net.IP, error) {
+	allocated, err := ipamManager.allocatedIps(block)
+	if err != nil {
+		return nil, err
+	}
+
+	for ip := firstFreeIp(layout, block, allocated); ip != nil; ip = firstFreeIp(layout, block, allocated) {
+		created, err := ipamManager.claimIp(ip, block, owner)
+		if err != nil || created {
+			return ip, err
+		}
+
+		allocated[ip.String()] = true
+	}
+
+	return nil, nil
+}
+
+// claimIp creates the YarpIPAllocation of the address, false meaning it is already taken
+func (ipamManager *CrdIpamClient) claimIp(ip net.IP, block *net.IPNet, owner string) (bool, error) {
+	spec := YarpIPAllocationSpec{
+		Pool:          ipamManager.Config.Pool,
+		Ip:            ip.String(),
+		Node:          ipamManager.Config.NodeName,
+		PodNamespace:  ipamManager.Config.PodNamespace,
+		PodName:       ipamManager.Config.PodName,
+		ContainerId:   ipamManager.Config.ContainerId,
+		InterfaceName: ipamManager.Config.InterfaceName,
+	}
+	if owner == gatewayOwner {
+		spec = YarpIPAllocationSpec{Pool: ipamManager.Config.Pool, Ip: ip.String(), Node: ipamManager.Config.NodeName, PodName: gatewayOwner}
+	}
+
+	allocation := &YarpIPAllocation{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: crdGroup + "/" + crdVersion,
+			Kind:       "YarpIPAllocation",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ipamManager.allocationName(ip),
+			Labels: map[string]string{
+				crdPoolLabel:  ipamManager.Config.Pool,
+				crdBlockLabel: blockSegment(block),
+			},
+		},
+		Spec: spec,
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(allocation)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = ipamManager.Client.Resource(ipAllocationResource).Create(context.Background(), &unstructured.Unstructured{Object: content}, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// releaseAllocation deletes the allocation of an address claimed by this ADD but not used in the end
+func (ipamManager *CrdIpamClient) releaseAllocation(ip net.IP) {
+	err := ipamManager.Client.Resource(ipAllocationResource).Delete(context.Background(), ipamManager.allocationName(ip), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		ipamManager.Log.Warn(fmt.Sprintf("unable to release [%s]: %s", ip, err))
+	}
+}
+
+// allocatedIps lists the addresses claimed in the block
+func (ipamManager *CrdIpamClient) allocatedIps(block *net.IPNet) (map[string]bool, error) {
+	list, err := ipamManager.Client.Resource(ipAllocationResource).List(context.Background(), metav1.ListOptions{LabelSelector: ipamManager.blockSelector(block)})
+	if err != nil {
+		return nil, err
+	}
+
+	allocated := map[string]bool{}
+	for _, item := range list.Items {
+		ip, _, _ := unstructured.NestedString(item.Object, "spec", "ip")
+		allocated[ip] = true
+	}
+
+	return allocated, nil
+}
+
+func (ipamManager *CrdIpamClient) blockSelector(block *net.IPNet) string {
+	return labels.SelectorFromSet(labels.Set{
+		crdPoolLabel:  ipamManager.Config.Pool,
+		crdBlockLabel: blockSegment(block),
+	}).String()
+}
+
+// claimFreeBlock claims the first block of the pool no node owns yet
+func (ipamManager *CrdIpamClient) claimFreeBlock() (*net.IPNet, error) {
+	var block *net.IPNet
+	err := ipamManager.updatePool(func(pool *YarpIPPool, layout *blockPool) (bool, error) {
+		for i := 0; i < layout.blockCount(); i++ {
+			block = layout.block(i)
+			if _, claimed := pool.Spec.Blocks[block.String()]; !claimed {
+				ipamManager.claimBlock(pool, block)
+				return true, nil
+			}
+		}
+
+		return false, &PoolError{Pool: ipamManager.Config.Pool, Reason: "has no free block left"}
+	})
+
+	return block, err
+}
+
+func (ipamManager *CrdIpamClient) claimBlock(pool *YarpIPPool, block *net.IPNet) {
+	if pool.Spec.Blocks == nil {
+		pool.Spec.Blocks = map[string]string{}
+	}
+	pool.Spec.Blocks[block.String()] = ipamManager.Config.NodeName
+	ipamManager.Log.Info(fmt.Sprintf("Node [%s] claimed block [%s]", ipamManager.Config.NodeName, block))
+}
+
+// nodeBlocks lists the blocks of the node, in address order
+func (ipamManager *CrdIpamClient) nodeBlocks(pool *YarpIPPool, layout *blockPool) []*net.IPNet {
+	blocks := []*net.IPNet{}
+	for i := 0; i < layout.blockCount(); i++ {
+		block := layout.block(i)
+		if pool.Spec.Blocks[block.String()] == ipamManager.Config.NodeName {
+			blocks = append(blocks, block)
+		}
+	}
+
+	return blocks
+}
+
+// loadPool reads the pool and checks its layout
+func (ipamManager *CrdIpamClient) loadPool() (*YarpIPPool, *blockPool, error) {
+	object, err := ipamManager.Client.Resource(ipPoolResource).Get(context.Background(), ipamManager.Config.Pool, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pool := &YarpIPPool{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(object.UnstructuredContent(), pool)
+	if err != nil {
+		return nil, nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: fmt.Sprintf("is malformed: %s", err)}
+	}
+
+	_, cidr, err := net.ParseCIDR(pool.Spec.CIDR)
+	if err != nil || cidr.IP.To4() == nil {
+		return nil, nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: fmt.Sprintf("has an invalid cidr [%s]", pool.Spec.CIDR)}
+	}
+
+	blockSize := pool.Spec.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	poolSize, _ := cidr.Mask.Size()
+	if blockSize < poolSize || blockSize > 30 {
+		return nil, nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: fmt.Sprintf("has an invalid block size [%d]", blockSize)}
+	}
+
+	return pool, &blockPool{cidr: cidr, blockSize: blockSize}, nil
+}
+
+// updatePool applies change to the latest version of the pool and writes it back if change says so.
+// A concurrent update of the pool makes the write fail on its resourceVersion, the change is then replayed.
+func (ipamManager *CrdIpamClient) updatePool(change func(pool *YarpIPPool, layout *blockPool) (bool, error)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, layout, err := ipamManager.loadPool()
+		if err != nil {
+			return err
+		}
+
+		changed, err := change(pool, layout)
+		if err != nil || !changed {
+			return err
+		}
+
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+		if err != nil {
+			return err
+		}
+
+		_, err = ipamManager.Client.Resource(ipPoolResource).Update(context.Background(), &unstructured.Unstructured{Object: content}, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// owns tells whether the address was claimed by this node and, when both are known, this container
+func (ipamManager *CrdIpamClient) owns(allocation *YarpIPAllocationSpec) bool {
+	if allocation.Node != ipamManager.Config.NodeName {
+		return false
+	}
+
+	return allocation.ContainerId == "" || ipamManager.Config.ContainerId == "" || allocation.ContainerId == ipamManager.Config.ContainerId
+}
+
+func (ipamManager *CrdIpamClient) allocationName(ip net.IP) string {
+	return fmt.Sprintf("%s-%s", ipamManager.Config.Pool, strings.ReplaceAll(ip.To4().String(), ".", "-"))
+}
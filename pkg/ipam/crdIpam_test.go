@@ -0,0 +1,276 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newFakeDynamicClient(cidr string, blockSize int) *dynamicfake.FakeDynamicClient {
+	pool := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": crdGroup + "/" + crdVersion,
+		"kind":       "YarpIPPool",
+		"metadata":   map[string]interface{}{"name": DefaultPoolName},
+		"spec":       map[string]interface{}{"cidr": cidr, "blockSize": int64(blockSize)},
+	}}
+
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		ipPoolResource:       "YarpIPPoolList",
+		ipAllocationResource: "YarpIPAllocationList",
+	}, pool)
+}
+
+func newTestCrdIpamClient(client *dynamicfake.FakeDynamicClient, nodeName string, podName string) *CrdIpamClient {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	return NewCrdIpamClient(logger, client, &CrdIpamClientConfig{
+		Pool:         DefaultPoolName,
+		NodeName:     nodeName,
+		PodNamespace: "default",
+		PodName:      podName,
+	})
+}
+
+func TestCrdAllocatesPerNodeBlocksAndGateways(t *testing.T) {
+	client := newFakeDynamicClient("10.244.0.0/24", 28)
+	nodeA := newTestCrdIpamClient(client, "node-a", "pod-a")
+	nodeB := newTestCrdIpamClient(client, "node-b", "pod-b")
+
+	for _, test := range []struct {
+		client   *CrdIpamClient
+		expected string
+	}{
+		{client: nodeA, expected: "10.244.0.1/28"},
+		{client: nodeB, expected: "10.244.0.17/28"},
+		{client: nodeA, expected: "10.244.0.1/28"}, // the gateway is stable
+	} {
+		_, gatewayNet, err := test.client.GetGatewayAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gatewayNet.String() != test.expected {
+			t.Fatalf("expected the gateway of %s to be [%s], got [%s]", test.client.Config.NodeName, test.expected, gatewayNet)
+		}
+	}
+
+	ip, block, err := nodeB.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.244.0.18" || block.String() != "10.244.0.16/28" {
+		t.Fatalf("expected node-b to allocate from its block, got [%s] in [%s]", ip, block)
+	}
+
+	blocks, err := nodeA.NodeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(blocks["node-a"]) != "[10.244.0.0/28]" || fmt.Sprint(blocks["node-b"]) != "[10.244.0.16/28]" {
+		t.Fatalf("unexpected blocks %v", blocks)
+	}
+}
+
+func TestCrdRetriesOnConflict(t *testing.T) {
+	client := newFakeDynamicClient("10.244.0.0/24", 28)
+	updates := 0
+	client.PrependReactor("update", ipPoolResource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 1 {
+			return true, nil, apierrors.NewConflict(ipPoolResource.GroupResource(), DefaultPoolName, fmt.Errorf("the object has been modified"))
+		}
+
+		return false, nil, nil
+	})
+
+	ip, _, err := newTestCrdIpamClient(client, "node-a", "pod-a").AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updates != 2 {
+		t.Fatalf("expected the update to be replayed once, got %d updates", updates)
+	}
+	if ip.String() != "10.244.0.1" {
+		t.Fatalf("expected 10.244.0.1, got %s", ip)
+	}
+}
+
+func TestCrdPoolExhaustion(t *testing.T) {
+	client := newFakeDynamicClient("10.244.0.0/27", 28)
+	ipamClient := newTestCrdIpamClient(client, "node-a", "pod-a")
+
+	// 2 blocks of 14 addresses
+	for i := 0; i < 2*14; i++ {
+		_, _, err := ipamClient.AllocateIpv4Address()
+		if err != nil {
+			t.Fatalf("allocation %d: %s", i, err)
+		}
+	}
+
+	_, _, err := ipamClient.AllocateIpv4Address()
+	var poolError *PoolError
+	if !errors.As(err, &poolError) {
+		t.Fatalf("expected a pool error, got %v", err)
+	}
+	if isUnreachable(err) {
+		t.Fatal("an exhausted pool must not fall back")
+	}
+}
+
+func TestCrdStaticAddressStaysInNodeBlocks(t *testing.T) {
+	client := newFakeDynamicClient("10.244.0.0/24", 28)
+	nodeA := newTestCrdIpamClient(client, "node-a", "pod-a")
+	nodeB := newTestCrdIpamClient(client, "node-b", "pod-b")
+
+	_, _, err := nodeA.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		client   *CrdIpamClient
+		ip       string
+		expected error
+	}{
+		{client: nodeB, ip: "10.244.0.5", expected: ErrIpOutOfRange},        // in the block of node-a
+		{client: nodeB, ip: "10.244.0.48", expected: ErrIpOutOfRange},       // network address of a block
+		{client: nodeB, ip: "10.244.0.63", expected: ErrIpOutOfRange},       // broadcast address of a block
+		{client: nodeB, ip: "10.244.1.5", expected: ErrIpOutOfRange},        // out of the pool
+		{client: nodeB, ip: "10.244.0.50", expected: nil},                   // claims the block for node-b
+		{client: nodeB, ip: "10.244.0.50", expected: ErrIpAlreadyAllocated}, // already allocated
+		{client: nodeA, ip: "10.244.0.5", expected: nil},
+	} {
+		_, _, err := test.client.AllocateStaticIpv4Address(net.ParseIP(test.ip))
+		if test.expected == nil && err != nil {
+			t.Errorf("%s for %s: unexpected error %s", test.ip, test.client.Config.NodeName, err)
+		}
+		if test.expected != nil && !errors.Is(err, test.expected) {
+			t.Errorf("%s for %s: expected %s, got %v", test.ip, test.client.Config.NodeName, test.expected, err)
+		}
+	}
+
+	blocks, err := nodeB.NodeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(blocks["node-b"]) != "[10.244.0.48/28]" {
+		t.Fatalf("expected node-b to own the block of its static address, got %v", blocks)
+	}
+}
+
+func TestCrdAllocationsDoNotUpdateThePool(t *testing.T) {
+	client := newFakeDynamicClient("10.244.0.0/24", 28)
+	updates := 0
+	client.PrependReactor("update", ipPoolResource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		return false, nil, nil
+	})
+
+	ipamClient := newTestCrdIpamClient(client, "node-a", "pod-a")
+	for i := 0; i < 10; i++ {
+		ip, _, err := ipamClient.AllocateIpv4Address()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ipamClient.DeAllocateIpv4Address(ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if updates != 1 {
+		t.Fatalf("expected the pool to be updated only to claim the block, got %d updates", updates)
+	}
+}
+
+func TestCrdSkipsAddressesTakenMeanwhile(t *testing.T) {
+	client := newFakeDynamicClient("10.244.0.0/24", 28)
+	creates := 0
+	client.PrependReactor("create", ipAllocationResource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		creates++
+		if creates == 1 {
+			return true, nil, apierrors.NewAlreadyExists(ipAllocationResource.GroupResource(), "default-10-244-0-1")
+		}
+
+		return false, nil, nil
+	})
+
+	ip, _, err := newTestCrdIpamClient(client, "node-a", "pod-a").AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.244.0.2" {
+		t.Fatalf("expected the next address, got %s", ip)
+	}
+}
+
+func TestCrdReleasesOnlyItsOwnAddresses(t *testing.T) {
+	client := newFakeDynamicClient("10.244.0.0/24", 28)
+	nodeA := newTestCrdIpamClient(client, "node-a", "pod-a")
+	nodeB := newTestCrdIpamClient(client, "node-b", "pod-b")
+
+	ip, _, err := nodeA.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = nodeB.DeAllocateIpv4Address(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = nodeA.AllocateStaticIpv4Address(ip)
+	if !errors.Is(err, ErrIpAlreadyAllocated) {
+		t.Fatalf("expected [%s] to stay allocated to node-a, got %v", ip, err)
+	}
+
+	err = nodeA.DeAllocateIpv4Address(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = nodeA.AllocateStaticIpv4Address(ip)
+	if err != nil {
+		t.Fatalf("expected [%s] to be released, got %v", ip, err)
+	}
+}
+
+func TestCrdDeAllocateAttachment(t *testing.T) {
+	client := newFakeDynamicClient("10.244.0.0/24", 28)
+	owner := newTestCrdIpamClient(client, "node-a", "pod-a")
+	owner.Config.ContainerId, owner.Config.InterfaceName = "c1", "eth0"
+	otherContainer := newTestCrdIpamClient(client, "node-a", "pod-b")
+	otherContainer.Config.ContainerId, otherContainer.Config.InterfaceName = "c2", "eth0"
+
+	ip, _, err := owner.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIp, _, err := otherContainer.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	released, err := newTestCrdIpamClient(client, "node-b", "").DeAllocateAttachment("c1", "eth0")
+	if err != nil || len(released) != 0 {
+		t.Fatalf("expected node-b to release nothing, got %v (%v)", released, err)
+	}
+
+	released, err = newTestCrdIpamClient(client, "node-a", "").DeAllocateAttachment("c1", "eth0")
+	if err != nil || fmt.Sprint(released) != fmt.Sprintf("[%s]", ip) {
+		t.Fatalf("expected [%s] to be released, got %v (%v)", ip, released, err)
+	}
+
+	_, _, err = owner.AllocateStaticIpv4Address(otherIp)
+	if !errors.Is(err, ErrIpAlreadyAllocated) {
+		t.Fatalf("expected [%s] of c2 to stay allocated, got %v", otherIp, err)
+	}
+}
@@ -0,0 +1,55 @@
+package ipam
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const crdGroup = "yarp-cni.io"
+const crdVersion = "v1alpha1"
+
+var ipPoolResource = schema.GroupVersionResource{Group: crdGroup, Version: crdVersion, Resource: "yarpippools"}
+var ipAllocationResource = schema.GroupVersionResource{Group: crdGroup, Version: crdVersion, Resource: "yarpipallocations"}
+
+// crdPoolLabel and crdBlockLabel select the allocations of a block
+const crdPoolLabel = crdGroup + "/pool"
+const crdBlockLabel = crdGroup + "/block"
+
+// gatewayOwner marks the gateway address in the allocations of a pool
+const gatewayOwner = "gateway"
+
+// YarpIPPool is the source of truth of the blocks of a pool: they are claimed under resourceVersion checks,
+// so two nodes never get the same block. Addresses are claimed with a YarpIPAllocation each.
+type YarpIPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              YarpIPPoolSpec `json:"spec"`
+}
+
+type YarpIPPoolSpec struct {
+	CIDR string `json:"cidr"`
+	// BlockSize is the prefix length of the blocks nodes claim, DefaultBlockSize when unset
+	BlockSize int `json:"blockSize,omitempty"`
+	// Blocks maps every claimed block to its node
+	Blocks map[string]string `json:"blocks,omitempty"`
+	// Gateways maps every node to the gateway address of its bridge, taken from its first block
+	Gateways map[string]string `json:"gateways,omitempty"`
+}
+
+// YarpIPAllocation is the claim of an address. It is named after the pool and the address,
+// so creating it fails with AlreadyExists when the address is taken.
+type YarpIPAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              YarpIPAllocationSpec `json:"spec"`
+}
+
+type YarpIPAllocationSpec struct {
+	Pool          string `json:"pool"`
+	Ip            string `json:"ip"`
+	Node          string `json:"node,omitempty"`
+	PodNamespace  string `json:"podNamespace,omitempty"`
+	PodName       string `json:"podName,omitempty"`
+	ContainerId   string `json:"containerId,omitempty"`
+	InterfaceName string `json:"interfaceName,omitempty"`
+}
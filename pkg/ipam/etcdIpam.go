@@ -0,0 +1,737 @@
+package ipam
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const etcdKeyPrefix = "/yarp/ipam"
+const DefaultBlockSize = 26
+
+const etcdDialTimeout = 5 * time.Second
+const etcdRequestTimeout = 10 * time.Second
+
+// etcdMaxAttempts bounds the retries of an allocation losing compare-and-swap races to other nodes
+const etcdMaxAttempts = 10
+
+type EtcdIpamClientConfig struct {
+	Pool string
+	// Subnet and BlockSize seed the pool when it does not exist yet
+	Subnet    string
+	BlockSize int
+	NodeName  string
+	// LeaseTtl, in seconds, attaches the blocks and addresses of the node to a lease, which the router grants and keeps alive.
+	// They are all released once the node is gone for that long. Zero disables the cleanup.
+	LeaseTtl      int64
+	PodNamespace  string
+	PodName       string
+	ContainerId   string
+	InterfaceName string
+}
+
+// EtcdIpamClient allocates addresses from a pool in etcd. The pool is split in blocks each node claims for itself,
+// so that the addresses of a node can be routed as a few prefixes. Every write is a transaction comparing
+// the revision of the key it creates, two nodes never win the same block or address.
+//
+// Keys, under /yarp/ipam/<pool>:
+//
+//	config                the cidr and block size of the pool
+//	nodes/<node>          the lease of the node
+//	blocks/<block>        the node owning the block
+//	ips/<block>/<ip>      the owner of the address
+//	gateways/<node>       the gateway address of the node
+type EtcdIpamClient struct {
+	Config *EtcdIpamClientConfig
+	Client *clientv3.Client
+	Log    *logrus.Logger
+}
+
+type etcdPoolConfig struct {
+	CIDR      string `json:"cidr"`
+	BlockSize int    `json:"blockSize"`
+}
+
+type etcdOwner struct {
+	Node          string `json:"node"`
+	PodNamespace  string `json:"podNamespace,omitempty"`
+	PodName       string `json:"podName,omitempty"`
+	ContainerId   string `json:"containerId,omitempty"`
+	InterfaceName string `json:"interfaceName,omitempty"`
+}
+
+// blockPool is the layout of a pool split in blocks, shared with the crd ipam
+type blockPool struct {
+	cidr      *net.IPNet
+	blockSize int
+}
+
+// NewEtcdClient connects to the endpoints, over TLS when the files are given
+func NewEtcdClient(endpoints []string, certFile string, keyFile string, caFile string) (*clientv3.Client, error) {
+	var tlsConfig *tls.Config
+	if certFile != "" || keyFile != "" || caFile != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      certFile,
+			KeyFile:       keyFile,
+			TrustedCAFile: caFile,
+		}
+
+		var err error
+		tlsConfig, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdDialTimeout,
+		TLS:         tlsConfig,
+	})
+}
+
+func NewEtcdIpamClient(logger *logrus.Logger, client *clientv3.Client, config *EtcdIpamClientConfig) *EtcdIpamClient {
+	return &EtcdIpamClient{
+		Config: config,
+		Client: client,
+		Log:    logger,
+	}
+}
+
+// GetGatewayAddress returns the gateway of the node, the first address it allocated, along with the block it is in.
+// Pods of the later blocks are outside of that subnet: they reach the gateway through an on-link route,
+// and the router routes their blocks to the bridge.
+func (ipamManager *EtcdIpamClient) GetGatewayAddress() (net.IP, *net.IPNet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	pool, err := ipamManager.loadPool(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gatewayKey := ipamManager.key("gateways", ipamManager.Config.NodeName)
+	for attempt := 0; attempt < etcdMaxAttempts; attempt++ {
+		response, err := ipamManager.Client.Get(ctx, gatewayKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(response.Kvs) > 0 {
+			gateway := net.ParseIP(string(response.Kvs[0].Value)).To4()
+			return gateway, &net.IPNet{IP: gateway, Mask: pool.blockOf(gateway).Mask}, nil
+		}
+
+		gateway, block, err := ipamManager.allocate(ctx, pool, gatewayOwner)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		lease, err := ipamManager.nodeLease(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		txn, err := ipamManager.Client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(gatewayKey), "=", 0)).
+			Then(clientv3.OpPut(gatewayKey, gateway.String(), clientv3.WithLease(lease))).
+			Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		if txn.Succeeded {
+			return gateway, &net.IPNet{IP: gateway, Mask: block.Mask}, nil
+		}
+
+		// Another invocation set the gateway first, ours goes back to the pool
+		_, err = ipamManager.Client.Delete(ctx, ipamManager.ipKey(pool, gateway))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return nil, nil, fmt.Errorf("unable to set the gateway of node [%s] after [%d] attempts", ipamManager.Config.NodeName, etcdMaxAttempts)
+}
+
+func (ipamManager *EtcdIpamClient) AllocateIpv4Address() (net.IP, *net.IPNet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	pool, err := ipamManager.loadPool(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ip, block, err := ipamManager.allocate(ctx, pool, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ipamManager.Log.Debug(fmt.Sprintf("Allocated [%s] from block [%s]", ip, block))
+	return ip, block, nil
+}
+
+func (ipamManager *EtcdIpamClient) AllocateStaticIpv4Address(requestedIp net.IP) (net.IP, *net.IPNet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	pool, err := ipamManager.loadPool(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Network and broadcast addresses, of the pool as of the block, are never handed out
+	ip := requestedIp.To4()
+	if ip == nil || !pool.cidr.Contains(ip) {
+		return nil, nil, fmt.Errorf("%w: [%s] is not usable in [%s]", ErrIpOutOfRange, requestedIp, pool.cidr)
+	}
+	block := pool.blockOf(ip)
+	if ip.Equal(block.IP) || ip.Equal(broadcastAddress(*block)) || ip.Equal(broadcastAddress(*pool.cidr)) {
+		return nil, nil, fmt.Errorf("%w: [%s] is not usable in [%s]", ErrIpOutOfRange, requestedIp, block)
+	}
+
+	// The address must stay routed to this node, so it has to come from one of its blocks
+	owner, err := ipamManager.ensureBlock(ctx, block)
+	if err != nil {
+		return nil, nil, err
+	}
+	if owner != ipamManager.Config.NodeName {
+		return nil, nil, fmt.Errorf("%w: [%s] is in block [%s] of node [%s]", ErrIpOutOfRange, requestedIp, block, owner)
+	}
+
+	claimed, err := ipamManager.claimIp(ctx, pool, ip, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !claimed {
+		return nil, nil, fmt.Errorf("%w: [%s]", ErrIpAlreadyAllocated, ip.String())
+	}
+
+	ipamManager.Log.Debug(fmt.Sprintf("Allocated static [%s]", ip))
+	return ip, block, nil
+}
+
+func (ipamManager *EtcdIpamClient) DeAllocateIpv4Address(ip net.IP) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	pool, err := ipamManager.loadPool(ctx)
+	if err != nil {
+		return err
+	}
+
+	ipKey := ipamManager.ipKey(pool, ip)
+	response, err := ipamManager.Client.Get(ctx, ipKey)
+	if err != nil {
+		return err
+	}
+	if len(response.Kvs) == 0 {
+		return nil
+	}
+
+	// A late DEL must not free an address that went to another pod, or another node, in the meantime
+	owner := &etcdOwner{}
+	err = json.Unmarshal(response.Kvs[0].Value, owner)
+	if err != nil {
+		return err
+	}
+	if !ipamManager.owns(owner) {
+		ipamManager.Log.Warn(fmt.Sprintf("Not releasing [%s], owned by [%+v]", ip.To4().String(), *owner))
+		return nil
+	}
+
+	txn, err := ipamManager.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(ipKey), "=", response.Kvs[0].ModRevision)).
+		Then(clientv3.OpDelete(ipKey)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return fmt.Errorf("[%s] changed while being released", ip.To4().String())
+	}
+
+	ipamManager.Log.Debug(fmt.Sprintf("DeAllocated [%s]", ip.To4().String()))
+	return nil
+}
+
+// DeAllocateAttachment releases the addresses the interface of the container holds in the blocks of the node
+func (ipamManager *EtcdIpamClient) DeAllocateAttachment(containerId string, interfaceName string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	blocks, err := ipamManager.nodeBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	released := []net.IP{}
+	for _, block := range blocks {
+		prefix := ipamManager.key("ips", blockSegment(block)) + "/"
+		response, err := ipamManager.Client.Get(ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range response.Kvs {
+			owner := &etcdOwner{}
+			err = json.Unmarshal(kv.Value, owner)
+			if err != nil {
+				return nil, err
+			}
+			if owner.Node != ipamManager.Config.NodeName || owner.ContainerId != containerId || owner.InterfaceName != interfaceName {
+				continue
+			}
+
+			// Only deleted if unchanged since read, like a single release
+			txn, err := ipamManager.Client.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+				Then(clientv3.OpDelete(string(kv.Key))).
+				Commit()
+			if err != nil {
+				return nil, err
+			}
+			if txn.Succeeded {
+				released = append(released, net.ParseIP(strings.TrimPrefix(string(kv.Key), prefix)).To4())
+			}
+		}
+	}
+
+	ipamManager.Log.Debug(fmt.Sprintf("DeAllocated %s of [%s/%s]", released, containerId, interfaceName))
+	return released, nil
+}
+
+// NodeBlocks lists the blocks of the pool by node, for the router to route them
+func (ipamManager *EtcdIpamClient) NodeBlocks() (map[string][]*net.IPNet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+
+	response, err := ipamManager.Client.Get(ctx, ipamManager.key("blocks")+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := map[string][]*net.IPNet{}
+	for _, kv := range response.Kvs {
+		block, err := ipamManager.parseBlockKey(string(kv.Key))
+		if err != nil {
+			return nil, err
+		}
+		blocks[string(kv.Value)] = append(blocks[string(kv.Value)], block)
+	}
+
+	return blocks, nil
+}
+
+// KeepNodeLeaseAlive renews the lease of the node until ctx is done or the lease is lost. Meant for the router,
+// the plugin itself does not live long enough.
+func (ipamManager *EtcdIpamClient) KeepNodeLeaseAlive(ctx context.Context) error {
+	if ipamManager.Config.LeaseTtl == 0 {
+		return fmt.Errorf("no lease ttl configured for node [%s]", ipamManager.Config.NodeName)
+	}
+
+	leaseCtx, cancel := context.WithTimeout(ctx, etcdRequestTimeout)
+	lease, err := ipamManager.grantNodeLease(leaseCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	responses, err := ipamManager.Client.KeepAlive(ctx, lease)
+	if err != nil {
+		return err
+	}
+
+	ipamManager.Log.Info(fmt.Sprintf("Keeping lease [%x] of node [%s] alive", lease, ipamManager.Config.NodeName))
+	for range responses {
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return fmt.Errorf("lost lease [%x] of node [%s]", lease, ipamManager.Config.NodeName)
+}
+
+// allocate hands out the first free address of the blocks of the node, claiming a new block when they are full
+func (ipamManager *EtcdIpamClient) allocate(ctx context.Context, pool *blockPool, owner string) (net.IP, *net.IPNet, error) {
+	for attempt := 0; attempt < etcdMaxAttempts; attempt++ {
+		blocks, err := ipamManager.nodeBlocks(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var candidate net.IP
+		var candidateBlock *net.IPNet
+		for _, block := range blocks {
+			allocated, err := ipamManager.allocatedIps(ctx, block)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			candidate = firstFreeIp(pool, block, allocated)
+			if candidate != nil {
+				candidateBlock = block
+				break
+			}
+		}
+
+		if candidate == nil {
+			_, err = ipamManager.claimBlock(ctx, pool)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		claimed, err := ipamManager.claimIp(ctx, pool, candidate, owner)
+		if err != nil {
+			return nil, nil, err
+		}
+		if claimed {
+			return candidate, candidateBlock, nil
+		}
+		// Lost the address to a concurrent invocation, look again
+	}
+
+	return nil, nil, fmt.Errorf("unable to allocate an address for node [%s] after [%d] attempts", ipamManager.Config.NodeName, etcdMaxAttempts)
+}
+
+// claimIp creates the key of the address, unless it already exists
+func (ipamManager *EtcdIpamClient) claimIp(ctx context.Context, pool *blockPool, ip net.IP, owner string) (bool, error) {
+	lease, err := ipamManager.nodeLease(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	record := etcdOwner{
+		Node:          ipamManager.Config.NodeName,
+		PodNamespace:  ipamManager.Config.PodNamespace,
+		PodName:       ipamManager.Config.PodName,
+		ContainerId:   ipamManager.Config.ContainerId,
+		InterfaceName: ipamManager.Config.InterfaceName,
+	}
+	if owner == gatewayOwner {
+		record = etcdOwner{Node: ipamManager.Config.NodeName, PodName: gatewayOwner}
+	}
+	content, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+
+	ipKey := ipamManager.ipKey(pool, ip)
+	txn, err := ipamManager.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(ipKey), "=", 0)).
+		Then(clientv3.OpPut(ipKey, string(content), clientv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+
+	return txn.Succeeded, nil
+}
+
+// claimBlock takes the first block of the pool no node owns yet
+func (ipamManager *EtcdIpamClient) claimBlock(ctx context.Context, pool *blockPool) (*net.IPNet, error) {
+	lease, err := ipamManager.nodeLease(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := ipamManager.Client.Get(ctx, ipamManager.key("blocks")+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	owned := map[string]bool{}
+	for _, kv := range response.Kvs {
+		owned[string(kv.Key)] = true
+	}
+
+	for i := 0; i < pool.blockCount(); i++ {
+		block := pool.block(i)
+		if owned[ipamManager.blockKey(block)] {
+			continue
+		}
+
+		claimed, err := ipamManager.claimBlockAt(ctx, block, lease)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return block, nil
+		}
+	}
+
+	return nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: "has no free block left"}
+}
+
+// claimBlockAt creates the key of the block, unless it already exists
+func (ipamManager *EtcdIpamClient) claimBlockAt(ctx context.Context, block *net.IPNet, lease clientv3.LeaseID) (bool, error) {
+	blockKey := ipamManager.blockKey(block)
+	txn, err := ipamManager.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(blockKey), "=", 0)).
+		Then(clientv3.OpPut(blockKey, ipamManager.Config.NodeName, clientv3.WithLease(lease))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+
+	if txn.Succeeded {
+		ipamManager.Log.Info(fmt.Sprintf("Node [%s] claimed block [%s]", ipamManager.Config.NodeName, block))
+	}
+	return txn.Succeeded, nil
+}
+
+// ensureBlock returns the node owning the block, claiming it for this node when nobody does
+func (ipamManager *EtcdIpamClient) ensureBlock(ctx context.Context, block *net.IPNet) (string, error) {
+	lease, err := ipamManager.nodeLease(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 0; attempt < etcdMaxAttempts; attempt++ {
+		response, err := ipamManager.Client.Get(ctx, ipamManager.blockKey(block))
+		if err != nil {
+			return "", err
+		}
+		if len(response.Kvs) > 0 {
+			return string(response.Kvs[0].Value), nil
+		}
+
+		claimed, err := ipamManager.claimBlockAt(ctx, block, lease)
+		if err != nil {
+			return "", err
+		}
+		if claimed {
+			return ipamManager.Config.NodeName, nil
+		}
+	}
+
+	return "", fmt.Errorf("unable to claim block [%s] after [%d] attempts", block, etcdMaxAttempts)
+}
+
+// nodeBlocks lists the blocks of the node, in address order
+func (ipamManager *EtcdIpamClient) nodeBlocks(ctx context.Context) ([]*net.IPNet, error) {
+	response, err := ipamManager.Client.Get(ctx, ipamManager.key("blocks")+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []*net.IPNet{}
+	for _, kv := range response.Kvs {
+		if string(kv.Value) != ipamManager.Config.NodeName {
+			continue
+		}
+
+		block, err := ipamManager.parseBlockKey(string(kv.Key))
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return binary.BigEndian.Uint32(blocks[i].IP.To4()) < binary.BigEndian.Uint32(blocks[j].IP.To4())
+	})
+	return blocks, nil
+}
+
+// allocatedIps only reads the addresses of the block
+func (ipamManager *EtcdIpamClient) allocatedIps(ctx context.Context, block *net.IPNet) (map[string]bool, error) {
+	prefix := ipamManager.key("ips", blockSegment(block)) + "/"
+	response, err := ipamManager.Client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	allocated := map[string]bool{}
+	for _, kv := range response.Kvs {
+		allocated[strings.TrimPrefix(string(kv.Key), prefix)] = true
+	}
+
+	return allocated, nil
+}
+
+// nodeLease returns the lease of the node. The plugin never grants it: a lease nobody renews would expire
+// along with every address of the running pods, so the router has to be running, for this very node name.
+func (ipamManager *EtcdIpamClient) nodeLease(ctx context.Context) (clientv3.LeaseID, error) {
+	if ipamManager.Config.LeaseTtl == 0 {
+		return clientv3.NoLease, nil
+	}
+
+	nodeKey := ipamManager.key("nodes", ipamManager.Config.NodeName)
+	response, err := ipamManager.Client.Get(ctx, nodeKey)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	if len(response.Kvs) == 0 {
+		return clientv3.NoLease, fmt.Errorf("no router keeps the lease of node [%s] alive, start it with NODE_NAME=%s or drop the lease ttl",
+			ipamManager.Config.NodeName, ipamManager.Config.NodeName)
+	}
+
+	lease, err := strconv.ParseInt(string(response.Kvs[0].Value), 16, 64)
+	return clientv3.LeaseID(lease), err
+}
+
+// grantNodeLease returns the lease of the node, granting it on first use. The node key is attached to the lease itself,
+// so it disappears along with an expired lease.
+func (ipamManager *EtcdIpamClient) grantNodeLease(ctx context.Context) (clientv3.LeaseID, error) {
+	nodeKey := ipamManager.key("nodes", ipamManager.Config.NodeName)
+	for attempt := 0; attempt < etcdMaxAttempts; attempt++ {
+		response, err := ipamManager.Client.Get(ctx, nodeKey)
+		if err != nil {
+			return clientv3.NoLease, err
+		}
+		if len(response.Kvs) > 0 {
+			lease, err := strconv.ParseInt(string(response.Kvs[0].Value), 16, 64)
+			return clientv3.LeaseID(lease), err
+		}
+
+		grant, err := ipamManager.Client.Grant(ctx, ipamManager.Config.LeaseTtl)
+		if err != nil {
+			return clientv3.NoLease, err
+		}
+
+		txn, err := ipamManager.Client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(nodeKey), "=", 0)).
+			Then(clientv3.OpPut(nodeKey, strconv.FormatInt(int64(grant.ID), 16), clientv3.WithLease(grant.ID))).
+			Commit()
+		if err != nil {
+			return clientv3.NoLease, err
+		}
+		if txn.Succeeded {
+			return grant.ID, nil
+		}
+
+		_, err = ipamManager.Client.Revoke(ctx, grant.ID)
+		if err != nil {
+			return clientv3.NoLease, err
+		}
+	}
+
+	return clientv3.NoLease, fmt.Errorf("unable to get the lease of node [%s] after [%d] attempts", ipamManager.Config.NodeName, etcdMaxAttempts)
+}
+
+// loadPool reads the pool, creating it from the configured subnet when missing
+func (ipamManager *EtcdIpamClient) loadPool(ctx context.Context) (*blockPool, error) {
+	configKey := ipamManager.key("config")
+	if ipamManager.Config.Subnet != "" {
+		blockSize := ipamManager.Config.BlockSize
+		if blockSize == 0 {
+			blockSize = DefaultBlockSize
+		}
+		content, err := json.Marshal(etcdPoolConfig{CIDR: ipamManager.Config.Subnet, BlockSize: blockSize})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = ipamManager.Client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(configKey), "=", 0)).
+			Then(clientv3.OpPut(configKey, string(content))).
+			Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := ipamManager.Client.Get(ctx, configKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Kvs) == 0 {
+		return nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: "does not exist"}
+	}
+
+	config := &etcdPoolConfig{}
+	err = json.Unmarshal(response.Kvs[0].Value, config)
+	if err != nil {
+		return nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: fmt.Sprintf("is malformed: %s", err)}
+	}
+
+	_, cidr, err := net.ParseCIDR(config.CIDR)
+	if err != nil || cidr.IP.To4() == nil {
+		return nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: fmt.Sprintf("has an invalid cidr [%s]", config.CIDR)}
+	}
+	poolSize, _ := cidr.Mask.Size()
+	if config.BlockSize < poolSize || config.BlockSize > 30 {
+		return nil, &PoolError{Pool: ipamManager.Config.Pool, Reason: fmt.Sprintf("has an invalid block size [%d]", config.BlockSize)}
+	}
+
+	return &blockPool{cidr: cidr, blockSize: config.BlockSize}, nil
+}
+
+func (ipamManager *EtcdIpamClient) key(parts ...string) string {
+	return strings.Join(append([]string{etcdKeyPrefix, ipamManager.Config.Pool}, parts...), "/")
+}
+
+func (ipamManager *EtcdIpamClient) blockKey(block *net.IPNet) string {
+	return ipamManager.key("blocks", blockSegment(block))
+}
+
+func (ipamManager *EtcdIpamClient) parseBlockKey(key string) (*net.IPNet, error) {
+	_, block, err := net.ParseCIDR(strings.Replace(strings.TrimPrefix(key, ipamManager.key("blocks")+"/"), "-", "/", 1))
+	return block, err
+}
+
+// ipKey groups the addresses by block, so a node only ever reads the addresses of its own blocks
+func (ipamManager *EtcdIpamClient) ipKey(pool *blockPool, ip net.IP) string {
+	return ipamManager.key("ips", blockSegment(pool.blockOf(ip)), ip.To4().String())
+}
+
+// owns tells whether the address was claimed by this node and, when both are known, this container
+func (ipamManager *EtcdIpamClient) owns(owner *etcdOwner) bool {
+	if owner.Node != ipamManager.Config.NodeName {
+		return false
+	}
+
+	return owner.ContainerId == "" || ipamManager.Config.ContainerId == "" || owner.ContainerId == ipamManager.Config.ContainerId
+}
+
+// blockSegment keeps the block a single path segment, 10.244.1.0/26 is stored as 10.244.1.0-26
+func blockSegment(block *net.IPNet) string {
+	return strings.Replace(block.String(), "/", "-", 1)
+}
+
+func (pool *blockPool) blockCount() int {
+	poolSize, _ := pool.cidr.Mask.Size()
+	return 1 << uint(pool.blockSize-poolSize)
+}
+
+func (pool *blockPool) block(index int) *net.IPNet {
+	base := binary.BigEndian.Uint32(pool.cidr.IP.To4())
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, base+uint32(index)<<uint(32-pool.blockSize))
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(pool.blockSize, 32)}
+}
+
+func (pool *blockPool) blockOf(ip net.IP) *net.IPNet {
+	mask := net.CIDRMask(pool.blockSize, 32)
+	return &net.IPNet{IP: ip.To4().Mask(mask), Mask: mask}
+}
+
+// firstFreeIp skips the network and broadcast addresses of the block, and of the pool
+func firstFreeIp(pool *blockPool, block *net.IPNet, allocated map[string]bool) net.IP {
+	first := binary.BigEndian.Uint32(block.IP.To4())
+	last := binary.BigEndian.Uint32(broadcastAddress(*block))
+
+	for value := first + 1; value < last; value++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, value)
+		if !allocated[ip.String()] && !ip.Equal(broadcastAddress(*pool.cidr)) {
+			return ip
+		}
+	}
+
+	return nil
+}
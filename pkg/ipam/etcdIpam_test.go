@@ -0,0 +1,340 @@
+package ipam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func freeLocalUrl(t *testing.T) url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+// startEtcd runs an embedded single member etcd for the duration of the test
+func startEtcd(t *testing.T) *clientv3.Client {
+	config := embed.NewConfig()
+	config.Dir = t.TempDir()
+	config.LogLevel = "error"
+	clientUrl, peerUrl := freeLocalUrl(t), freeLocalUrl(t)
+	config.LCUrls, config.ACUrls = []url.URL{clientUrl}, []url.URL{clientUrl}
+	config.LPUrls, config.APUrls = []url.URL{peerUrl}, []url.URL{peerUrl}
+	config.InitialCluster = config.InitialClusterFromName(config.Name)
+
+	server, err := embed.StartEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("embedded etcd did not start")
+	}
+
+	client, err := NewEtcdClient([]string{clientUrl.Host}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func newTestEtcdIpamClient(client *clientv3.Client, nodeName string, containerId string) *EtcdIpamClient {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	return NewEtcdIpamClient(logger, client, &EtcdIpamClientConfig{
+		Pool:        DefaultPoolName,
+		Subnet:      "10.244.0.0/24",
+		BlockSize:   28,
+		NodeName:    nodeName,
+		ContainerId: containerId,
+	})
+}
+
+func TestEtcdAllocatesFromNodeBlocks(t *testing.T) {
+	client := startEtcd(t)
+	nodeA := newTestEtcdIpamClient(client, "node-a", "c1")
+	nodeB := newTestEtcdIpamClient(client, "node-b", "c2")
+
+	gateway, gatewayNet, err := nodeA.GetGatewayAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gatewayNet.String() != "10.244.0.1/28" {
+		t.Fatalf("unexpected gateway [%s]", gatewayNet)
+	}
+
+	// The gateway is stable
+	again, _, err := nodeA.GetGatewayAddress()
+	if err != nil || !again.Equal(gateway) {
+		t.Fatalf("expected the gateway to stay [%s], got [%s] (%v)", gateway, again, err)
+	}
+
+	// A /28 holds 14 addresses, the gateway takes one
+	for i := 0; i < 13; i++ {
+		ip, block, err := nodeA.AllocateIpv4Address()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.String() != "10.244.0.0/28" {
+			t.Fatalf("expected [%s] in the first block, got [%s]", ip, block)
+		}
+	}
+
+	ip, block, err := nodeA.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.244.0.17" || block.String() != "10.244.0.16/28" {
+		t.Fatalf("expected a second block, got [%s] in [%s]", ip, block)
+	}
+
+	ip, block, err = nodeB.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.String() != "10.244.0.32/28" {
+		t.Fatalf("expected node-b in a block of its own, got [%s] in [%s]", ip, block)
+	}
+
+	blocks, err := nodeA.NodeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(blocks["node-a"]) != "[10.244.0.0/28 10.244.0.16/28]" || fmt.Sprint(blocks["node-b"]) != "[10.244.0.32/28]" {
+		t.Fatalf("unexpected blocks %v", blocks)
+	}
+}
+
+func TestEtcdConcurrentAllocationsAreUnique(t *testing.T) {
+	client := startEtcd(t)
+
+	var lock sync.Mutex
+	allocated := map[string]string{}
+	var group sync.WaitGroup
+	for worker := 0; worker < 6; worker++ {
+		nodeName := fmt.Sprintf("node-%d", worker%2)
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			ipamClient := newTestEtcdIpamClient(client, nodeName, "")
+			for i := 0; i < 10; i++ {
+				ip, _, err := ipamClient.AllocateIpv4Address()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				lock.Lock()
+				if other, ok := allocated[ip.String()]; ok {
+					t.Errorf("[%s] handed out to both [%s] and [%s]", ip, other, nodeName)
+				}
+				allocated[ip.String()] = nodeName
+				lock.Unlock()
+			}
+		}()
+	}
+	group.Wait()
+
+	if len(allocated) != 60 {
+		t.Fatalf("expected 60 addresses, got %d", len(allocated))
+	}
+}
+
+func TestEtcdPoolExhaustion(t *testing.T) {
+	client := startEtcd(t)
+	ipamClient := newTestEtcdIpamClient(client, "node-a", "")
+
+	// 16 blocks of 14 addresses
+	for i := 0; i < 16*14; i++ {
+		_, _, err := ipamClient.AllocateIpv4Address()
+		if err != nil {
+			t.Fatalf("allocation %d: %s", i, err)
+		}
+	}
+
+	_, _, err := ipamClient.AllocateIpv4Address()
+	var poolError *PoolError
+	if !errors.As(err, &poolError) {
+		t.Fatalf("expected a pool error, got %v", err)
+	}
+}
+
+func TestEtcdStaticAddressStaysInNodeBlocks(t *testing.T) {
+	client := startEtcd(t)
+	nodeA := newTestEtcdIpamClient(client, "node-a", "")
+	nodeB := newTestEtcdIpamClient(client, "node-b", "")
+
+	_, _, err := nodeA.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		client   *EtcdIpamClient
+		ip       string
+		expected error
+	}{
+		{client: nodeB, ip: "10.244.0.5", expected: ErrIpOutOfRange},        // in the block of node-a
+		{client: nodeB, ip: "10.244.0.48", expected: ErrIpOutOfRange},       // network address of a block
+		{client: nodeB, ip: "10.244.0.63", expected: ErrIpOutOfRange},       // broadcast address of a block
+		{client: nodeB, ip: "10.244.1.5", expected: ErrIpOutOfRange},        // out of the pool
+		{client: nodeB, ip: "10.244.0.50", expected: nil},                   // claims the block for node-b
+		{client: nodeB, ip: "10.244.0.50", expected: ErrIpAlreadyAllocated}, // already allocated
+		{client: nodeA, ip: "10.244.0.5", expected: nil},
+	} {
+		_, block, err := test.client.AllocateStaticIpv4Address(net.ParseIP(test.ip))
+		if test.expected == nil && err != nil {
+			t.Errorf("%s for %s: unexpected error %s", test.ip, test.client.Config.NodeName, err)
+		}
+		if test.expected != nil && !errors.Is(err, test.expected) {
+			t.Errorf("%s for %s: expected %s, got %v (%s)", test.ip, test.client.Config.NodeName, test.expected, err, block)
+		}
+	}
+
+	blocks, err := nodeB.NodeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(blocks["node-b"]) != "[10.244.0.48/28]" {
+		t.Fatalf("expected node-b to own the block of its static address, got %v", blocks)
+	}
+}
+
+func TestEtcdDeallocateChecksOwner(t *testing.T) {
+	client := startEtcd(t)
+	owner := newTestEtcdIpamClient(client, "node-a", "c1")
+	otherContainer := newTestEtcdIpamClient(client, "node-a", "c2")
+
+	ip, _, err := owner.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale DEL of another container leaves the address alone
+	err = otherContainer.DeAllocateIpv4Address(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = owner.AllocateStaticIpv4Address(ip)
+	if !errors.Is(err, ErrIpAlreadyAllocated) {
+		t.Fatalf("expected [%s] to still be allocated, got %v", ip, err)
+	}
+
+	err = owner.DeAllocateIpv4Address(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = owner.AllocateStaticIpv4Address(ip)
+	if err != nil {
+		t.Fatalf("expected [%s] to be released, got %v", ip, err)
+	}
+}
+
+func TestEtcdLeaseIsOwnedByTheRouter(t *testing.T) {
+	client := startEtcd(t)
+	plugin := newTestEtcdIpamClient(client, "node-a", "")
+	plugin.Config.LeaseTtl = 60
+
+	_, _, err := plugin.AllocateIpv4Address()
+	if err == nil || !strings.Contains(err.Error(), "no router keeps the lease") {
+		t.Fatalf("expected the plugin to refuse an unrenewed lease, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router := newTestEtcdIpamClient(client, "node-a", "")
+	router.Config.LeaseTtl = 60
+	go router.KeepNodeLeaseAlive(ctx)
+
+	var ip net.IP
+	for attempt := 0; attempt < 50; attempt++ {
+		ip, _, err = plugin.AllocateIpv4Address()
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the lease is gone, so are the blocks and addresses of the node
+	response, err := client.Get(context.Background(), plugin.key("nodes", "node-a"))
+	if err != nil || len(response.Kvs) == 0 {
+		t.Fatalf("expected the node key, got %v", err)
+	}
+	lease, err := strconv.ParseInt(string(response.Kvs[0].Value), 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Revoke(context.Background(), clientv3.LeaseID(lease))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := plugin.NodeBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 0 {
+		t.Fatalf("expected no block left, got %v", blocks)
+	}
+	response, err = client.Get(context.Background(), plugin.key("ips"), clientv3.WithPrefix())
+	if err != nil || len(response.Kvs) != 0 {
+		t.Fatalf("expected [%s] to be released, got %d keys (%v)", ip, len(response.Kvs), err)
+	}
+}
+
+func TestEtcdDeAllocateAttachment(t *testing.T) {
+	client := startEtcd(t)
+	owner := newTestEtcdIpamClient(client, "node-a", "c1")
+	owner.Config.InterfaceName = "eth0"
+	otherContainer := newTestEtcdIpamClient(client, "node-a", "c2")
+	otherContainer.Config.InterfaceName = "eth0"
+
+	ip, _, err := owner.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIp, _, err := otherContainer.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node only looks at its own blocks
+	released, err := newTestEtcdIpamClient(client, "node-b", "").DeAllocateAttachment("c1", "eth0")
+	if err != nil || len(released) != 0 {
+		t.Fatalf("expected node-b to release nothing, got %v (%v)", released, err)
+	}
+
+	released, err = newTestEtcdIpamClient(client, "node-a", "").DeAllocateAttachment("c1", "eth0")
+	if err != nil || fmt.Sprint(released) != fmt.Sprintf("[%s]", ip) {
+		t.Fatalf("expected [%s] to be released, got %v (%v)", ip, released, err)
+	}
+
+	_, _, err = owner.AllocateStaticIpv4Address(otherIp)
+	if !errors.Is(err, ErrIpAlreadyAllocated) {
+		t.Fatalf("expected [%s] of c2 to stay allocated, got %v", otherIp, err)
+	}
+}
@@ -0,0 +1,125 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// FallbackIpamClient serves from Primary, and from Fallback while Primary cannot be reached,
+// e.g. the CRD pools during an API server outage and the node local db instead
+type FallbackIpamClient struct {
+	Primary  IPAM
+	Fallback IPAM
+	Log      *logrus.Logger
+}
+
+func NewFallbackIpamClient(logger *logrus.Logger, primary IPAM, fallback IPAM) *FallbackIpamClient {
+	return &FallbackIpamClient{
+		Primary:  primary,
+		Fallback: fallback,
+		Log:      logger,
+	}
+}
+
+func (ipamManager *FallbackIpamClient) GetGatewayAddress() (net.IP, *net.IPNet, error) {
+	ip, ipNet, err := ipamManager.Primary.GetGatewayAddress()
+	if isUnreachable(err) {
+		ipamManager.warn(err)
+		return ipamManager.Fallback.GetGatewayAddress()
+	}
+
+	return ip, ipNet, err
+}
+
+func (ipamManager *FallbackIpamClient) AllocateIpv4Address() (net.IP, *net.IPNet, error) {
+	ip, ipNet, err := ipamManager.Primary.AllocateIpv4Address()
+	if isUnreachable(err) {
+		ipamManager.warn(err)
+		return ipamManager.Fallback.AllocateIpv4Address()
+	}
+
+	return ip, ipNet, err
+}
+
+func (ipamManager *FallbackIpamClient) AllocateStaticIpv4Address(requestedIp net.IP) (net.IP, *net.IPNet, error) {
+	ip, ipNet, err := ipamManager.Primary.AllocateStaticIpv4Address(requestedIp)
+	if isUnreachable(err) {
+		ipamManager.warn(err)
+		return ipamManager.Fallback.AllocateStaticIpv4Address(requestedIp)
+	}
+
+	return ip, ipNet, err
+}
+
+// DeAllocateIpv4Address releases the address from both, as it may have been allocated during an outage
+func (ipamManager *FallbackIpamClient) DeAllocateIpv4Address(ip net.IP) error {
+	err := ipamManager.Primary.DeAllocateIpv4Address(ip)
+	if isUnreachable(err) {
+		ipamManager.warn(err)
+		return ipamManager.Fallback.DeAllocateIpv4Address(ip)
+	}
+	if err != nil {
+		return err
+	}
+
+	fallbackErr := ipamManager.Fallback.DeAllocateIpv4Address(ip)
+	if fallbackErr != nil {
+		ipamManager.Log.Debug(fmt.Sprintf("unable to release [%s] from the fallback: %s", ip, fallbackErr))
+	}
+
+	return nil
+}
+
+// DeAllocateAttachment releases the addresses of the attachment from both, for those of them recording it
+func (ipamManager *FallbackIpamClient) DeAllocateAttachment(containerId string, interfaceName string) ([]net.IP, error) {
+	released := []net.IP{}
+	if primary, ok := ipamManager.Primary.(AttachmentReleaser); ok {
+		ips, err := primary.DeAllocateAttachment(containerId, interfaceName)
+		if err != nil && !isUnreachable(err) {
+			return nil, err
+		}
+		if err != nil {
+			ipamManager.warn(err)
+		}
+		released = append(released, ips...)
+	}
+
+	if fallback, ok := ipamManager.Fallback.(AttachmentReleaser); ok {
+		ips, err := fallback.DeAllocateAttachment(containerId, interfaceName)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, ips...)
+	}
+
+	return released, nil
+}
+
+func (ipamManager *FallbackIpamClient) warn(err error) {
+	ipamManager.Log.Warn(fmt.Sprintf("Primary IPAM unreachable, falling back: %s", err))
+}
+
+// isUnreachable tells transport failures and server unavailability apart from the answers of a reachable
+// API server, like a conflict or a pool running out of addresses, which are not worth a fallback
+func isUnreachable(err error) bool {
+	if err == nil || errors.Is(err, ErrIpAlreadyAllocated) || errors.Is(err, ErrIpOutOfRange) {
+		return false
+	}
+
+	if apierrors.IsServiceUnavailable(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) {
+		return true
+	}
+
+	var status apierrors.APIStatus
+	return !errors.As(err, &status) && !isPoolError(err)
+}
+
+// isPoolError is true for the errors CrdIpamClient raises on the content of the pool itself
+func isPoolError(err error) bool {
+	var poolErr *PoolError
+	return errors.As(err, &poolErr)
+}
@@ -0,0 +1,92 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestIsUnreachable(t *testing.T) {
+	resource := ipPoolResource.GroupResource()
+	for _, test := range []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "no error", err: nil, expected: false},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, expected: true},
+		{name: "unavailable", err: apierrors.NewServiceUnavailable("restarting"), expected: true},
+		{name: "server timeout", err: apierrors.NewServerTimeout(resource, "get", 1), expected: true},
+		{name: "throttled", err: apierrors.NewTooManyRequests("slow down", 1), expected: true},
+		{name: "conflict", err: apierrors.NewConflict(resource, DefaultPoolName, fmt.Errorf("modified")), expected: false},
+		{name: "missing pool", err: apierrors.NewNotFound(resource, DefaultPoolName), expected: false},
+		{name: "forbidden", err: apierrors.NewForbidden(resource, DefaultPoolName, fmt.Errorf("rbac")), expected: false},
+		{name: "pool error", err: &PoolError{Pool: DefaultPoolName, Reason: "has no free block left"}, expected: false},
+		{name: "allocated", err: fmt.Errorf("%w: [10.0.0.1]", ErrIpAlreadyAllocated), expected: false},
+		{name: "out of range", err: fmt.Errorf("%w: [10.0.0.0]", ErrIpOutOfRange), expected: false},
+	} {
+		if isUnreachable(test.err) != test.expected {
+			t.Errorf("%s: expected %t", test.name, test.expected)
+		}
+	}
+}
+
+func TestFallbackWhileApiServerIsUnreachable(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	client := newFakeDynamicClient("10.244.0.0/24", 28)
+	reachable := false
+	client.PrependReactor("get", ipPoolResource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if reachable {
+			return false, nil, nil
+		}
+
+		return true, nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	})
+
+	fallbackIpam := NewFallbackIpamClient(logger, newTestCrdIpamClient(client, "node-a", "pod-a"), NewLocalIpamClient(logger, &LocalIpamClientConfig{
+		IpamDbPath: filepath.Join(t.TempDir(), "ipam.db"),
+		Subnet:     "10.245.0.0/24",
+	}))
+
+	ip, _, err := fallbackIpam.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.245.0.1" {
+		t.Fatalf("expected an address of the fallback, got %s", ip)
+	}
+
+	// Once the API server is back, answers come from the pool again, errors included
+	reachable = true
+	ip, _, err = fallbackIpam.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "10.244.0.1" {
+		t.Fatalf("expected an address of the pool, got %s", ip)
+	}
+
+	_, _, err = fallbackIpam.AllocateStaticIpv4Address(net.ParseIP("10.245.0.2"))
+	if err == nil {
+		t.Fatal("expected the pool to refuse an address out of its range rather than fall back")
+	}
+
+	// The release reaches both, as the address may come from either
+	err = fallbackIpam.DeAllocateIpv4Address(net.ParseIP("10.245.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = fallbackIpam.Fallback.AllocateStaticIpv4Address(net.ParseIP("10.245.0.1"))
+	if err != nil {
+		t.Fatalf("expected 10.245.0.1 to be released from the fallback, got %v", err)
+	}
+}
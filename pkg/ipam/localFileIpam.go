@@ -1,32 +1,34 @@
 package ipam
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
-	"yarp-cni/pkg/utils"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 )
 
 type LocalIpamClientConfig struct {
 	IpamDbPath string
-}
-
-type LocalIpamConfigFile struct {
-	CIDR           string   `json:"CIDR"`
-	GatewayAddress string   `json:"gateway,omitempty"`
-	AllocatedIps   []string `json:"AllocatedIps"`
+	// Subnet seeds the db when it does not exist yet
+	Subnet string
+	// ContainerId and InterfaceName are recorded as the owner of the addresses allocated, when set
+	ContainerId   string
+	InterfaceName string
 }
 
 type LocalIpamClient struct {
 	Config *LocalIpamClientConfig
 	Log    *logrus.Logger
+
+	lockFile *os.File
 }
 
+// fileMutex serializes the goroutines of this process, the lock file the processes of the node
 var fileMutex sync.Mutex
 
 func NewLocalIpamClient(logger *logrus.Logger, config *LocalIpamClientConfig) *LocalIpamClient {
@@ -44,162 +46,396 @@ func (ipamManager *LocalIpamClient) AllocateIpv4Address() (net.IP, *net.IPNet, e
 	return ipamManager.allocateIP()
 }
 
+func (ipamManager *LocalIpamClient) AllocateStaticIpv4Address(ip net.IP) (net.IP, *net.IPNet, error) {
+	return ipamManager.allocateStaticIP(ip)
+}
+
 func (ipamManager *LocalIpamClient) DeAllocateIpv4Address(ip net.IP) error {
 	return ipamManager.deAllocateIP(ip)
 }
 
-func (ipamManager *LocalIpamClient) gatewayAddress() (net.IP, *net.IPNet, error) {
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
+// DeAllocateAttachment releases the addresses recorded for the interface of the container
+func (ipamManager *LocalIpamClient) DeAllocateAttachment(containerId string, interfaceName string) ([]net.IP, error) {
+	err := ipamManager.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer ipamManager.unlock()
 
-	// Load current DB
-	ips, err := ipamManager.loadDB()
+	owners, err := ioutil.ReadDir(ipamManager.ownersDir())
+	if os.IsNotExist(err) {
+		return []net.IP{}, nil
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	db, err := ipamManager.loadDB()
+	if err != nil {
+		return nil, err
 	}
 
-	if ips.GatewayAddress != "" {
-		_, ipNet, err := net.ParseCIDR(ips.CIDR)
+	released := []net.IP{}
+	for _, owner := range owners {
+		content, err := ioutil.ReadFile(filepath.Join(ipamManager.ownersDir(), owner.Name()))
 		if err != nil {
-			return nil, nil, err
+			return nil, err
+		}
+		if string(content) != ownerRecord(containerId, interfaceName) {
+			continue
 		}
-		ip := net.ParseIP(ips.GatewayAddress)
-		ipNet.IP = ip
 
-		return ip, ipNet, nil
+		ip := net.ParseIP(owner.Name())
+		if r, offset, ok := db.rangeOf(ip); ok && r.isSet(offset) {
+			r.clear(offset)
+			released = append(released, ip.To4())
+		}
+	}
+	if len(released) == 0 {
+		return released, nil
 	}
 
-	// Generate next valid IP
-	fileMutex.Unlock()
-	ip, ipNet, err := ipamManager.allocateIP()
+	err = ipamManager.writeDB(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range released {
+		ipamManager.forgetOwner(ip)
+		ipamManager.Log.Debug(fmt.Sprintf("DeAllocated [%s] of [%s/%s]", ip, containerId, interfaceName))
+	}
+
+	return released, nil
+}
+
+// Ranges lists the ranges of the db along with the number of addresses still free in them
+func (ipamManager *LocalIpamClient) Ranges() ([]*net.IPNet, int, error) {
+	err := ipamManager.lock()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer ipamManager.unlock()
+
+	db, err := ipamManager.loadDB()
+	if os.IsNotExist(err) {
+		return []*net.IPNet{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return db.networks(), db.free(), nil
+}
+
+// AddRange makes a block available for allocation, creating the db if needed
+func (ipamManager *LocalIpamClient) AddRange(block *net.IPNet) error {
+	err := ipamManager.lock()
+	if err != nil {
+		return err
+	}
+	defer ipamManager.unlock()
+
+	db, err := ipamManager.loadDB()
+	if os.IsNotExist(err) {
+		db, err = &localIpamDb{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, network := range db.networks() {
+		if network.String() == block.String() {
+			return nil
+		}
+	}
+
+	err = db.addRange(block)
+	if err != nil {
+		return err
+	}
+
+	err = ipamManager.writeDB(db)
+	if err != nil {
+		return err
+	}
+
+	ipamManager.Log.Info(fmt.Sprintf("Added range [%s]", block))
+	return nil
+}
+
+// ReleaseEmptyRange removes one block without any allocation and returns it, or nil if none can go.
+// At least keepFree addresses are left free, and the first range is never released as it holds the gateway.
+func (ipamManager *LocalIpamClient) ReleaseEmptyRange(keepFree int) (*net.IPNet, error) {
+	err := ipamManager.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer ipamManager.unlock()
+
+	db, err := ipamManager.loadDB()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	free := db.free()
+	for i := 1; i < len(db.Ranges); i++ {
+		r := db.Ranges[i]
+		if r.allocated() > 0 || free-r.free() < keepFree {
+			continue
+		}
+
+		db.Ranges = append(db.Ranges[:i], db.Ranges[i+1:]...)
+		err = ipamManager.writeDB(db)
+		if err != nil {
+			return nil, err
+		}
+
+		ipamManager.Log.Info(fmt.Sprintf("Released range [%s]", r.Network))
+		return r.Network, nil
+	}
+
+	return nil, nil
+}
+
+func (ipamManager *LocalIpamClient) gatewayAddress() (net.IP, *net.IPNet, error) {
+	err := ipamManager.lock()
 	if err != nil {
 		return nil, nil, err
 	}
+	defer ipamManager.unlock()
 
-	// Write new DB
-	fileMutex.Lock()
-	ips, err = ipamManager.loadDB()
+	// Load current DB
+	db, err := ipamManager.loadDB()
 	if err != nil {
 		return nil, nil, err
 	}
+	if len(db.Ranges) == 0 {
+		return nil, nil, fmt.Errorf("%w: the ipam db has no range", ErrNoFreeIp)
+	}
+
+	// The gateway always comes from the first range
+	first := db.Ranges[0]
+	if db.Gateway != nil {
+		return db.Gateway, &net.IPNet{IP: db.Gateway, Mask: first.Network.Mask}, nil
+	}
+
+	// The lowest free address, regardless of the cursor
+	offset, ok := first.nextFree(1)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w in [%s]", ErrNoFreeIp, first.Network)
+	}
 
-	ips.GatewayAddress = ip.To4().String()
-	err = ipamManager.writeDB(ips)
+	// Write new DB
+	first.set(offset)
+	db.Gateway = first.ip(offset)
+	err = ipamManager.writeDB(db)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return ip, ipNet, nil
+	return db.Gateway, &net.IPNet{IP: db.Gateway, Mask: first.Network.Mask}, nil
 }
 
 func (ipamManager *LocalIpamClient) allocateIP() (net.IP, *net.IPNet, error) {
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
+	err := ipamManager.lock()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ipamManager.unlock()
 
 	// Load current DB
-	ips, err := ipamManager.loadDB()
+	db, err := ipamManager.loadDB()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Generate next valid IP
-	ip, ipNet, err := net.ParseCIDR(ips.CIDR)
+	// Fill the ranges in order, each one round-robin from its cursor
+	for _, r := range db.Ranges {
+		ip, ok := r.allocate()
+		if !ok {
+			continue
+		}
+
+		// Write new DB
+		err = ipamManager.writeDBWithOwner(db, ip)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ipamManager.Log.Debug(fmt.Sprintf("Allocated [%s]", ip))
+		return ip, &net.IPNet{IP: r.Network.IP, Mask: r.Network.Mask}, nil
+	}
+
+	return nil, nil, ErrNoFreeIp
+}
+
+func (ipamManager *LocalIpamClient) allocateStaticIP(requestedIp net.IP) (net.IP, *net.IPNet, error) {
+	err := ipamManager.lock()
 	if err != nil {
 		return nil, nil, err
 	}
-	//Skip reserved IP
-	ip, err = nextIpInCidr(ip, *ipNet)
+	defer ipamManager.unlock()
+
+	// Load current DB
+	db, err := ipamManager.loadDB()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	for utils.Contains(ips.AllocatedIps, ip.To4().String()) {
-		ip, err = nextIpInCidr(ip, *ipNet)
-		if err != nil {
-			return nil, nil, err
-		}
+	// Network and broadcast addresses are never handed out
+	r, offset, ok := db.rangeOf(requestedIp)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: [%s] is not usable in %s", ErrIpOutOfRange, requestedIp, db.networks())
 	}
 
-	// Write new DB
-	ips.AllocatedIps = append(ips.AllocatedIps, ip.To4().String())
-	err = ipamManager.writeDB(ips)
+	ip := r.ip(offset)
+	if r.isSet(offset) {
+		return nil, nil, fmt.Errorf("%w: [%s]", ErrIpAlreadyAllocated, ip)
+	}
+
+	// Write new DB, leaving the cursor where it was
+	r.set(offset)
+	err = ipamManager.writeDBWithOwner(db, ip)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	ipamManager.Log.Debug(fmt.Sprintf("Allocated [%s]", ip.To4().String()))
-	return ip, ipNet, nil
+	ipamManager.Log.Debug(fmt.Sprintf("Allocated static [%s]", ip))
+	return ip, &net.IPNet{IP: r.Network.IP, Mask: r.Network.Mask}, nil
 }
 
 func (ipamManager *LocalIpamClient) deAllocateIP(ip net.IP) error {
-	fileMutex.Lock()
-	defer fileMutex.Unlock()
+	err := ipamManager.lock()
+	if err != nil {
+		return err
+	}
+	defer ipamManager.unlock()
 
 	// Load current DB
-	ips, err := ipamManager.loadDB()
+	db, err := ipamManager.loadDB()
 	if err != nil {
 		return err
 	}
 
-	s := utils.Remove(ips.AllocatedIps, ip.To4().String())
-	ips.AllocatedIps = s
+	r, offset, ok := db.rangeOf(ip)
+	if !ok || !r.isSet(offset) {
+		return nil
+	}
+	r.clear(offset)
 
 	// Write new DB
-	err = ipamManager.writeDB(ips)
+	err = ipamManager.writeDB(db)
 	if err != nil {
 		return err
 	}
+	ipamManager.forgetOwner(ip)
 
 	ipamManager.Log.Debug(fmt.Sprintf("DeAllocated [%s]", ip.To4().String()))
 	return nil
 }
 
-func nextIpInCidr(ip net.IP, cidr net.IPNet) (net.IP, error) {
-	for i := len(ip) - 1; i >= 0; i-- {
-		ip[i]++
-		if ip[i] != 0 {
-			break
-		}
-	}
-
-	if !cidr.Contains(ip) {
-		return ip, fmt.Errorf("next IP is over the CIDR range")
+func broadcastAddress(cidr net.IPNet) net.IP {
+	ip := cidr.IP.To4()
+	broadcast := make(net.IP, len(ip))
+	for i := range ip {
+		broadcast[i] = ip[i] | ^cidr.Mask[i]
 	}
 
-	return ip, nil
+	return broadcast
 }
 
-func (ipamManager *LocalIpamClient) loadDB() (*LocalIpamConfigFile, error) {
-	db, err := os.Open(ipamManager.Config.IpamDbPath)
+func (ipamManager *LocalIpamClient) lock() error {
+	fileMutex.Lock()
+
+	lockFile, err := os.OpenFile(ipamManager.Config.IpamDbPath+".lock", os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		return nil, err
+		fileMutex.Unlock()
+		return err
 	}
-	defer db.Close()
 
-	content, err := ioutil.ReadAll(db)
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
 	if err != nil {
-		return nil, err
+		lockFile.Close()
+		fileMutex.Unlock()
+		return err
 	}
 
-	dbFile := &LocalIpamConfigFile{}
-	err = json.Unmarshal([]byte(content), &dbFile)
+	ipamManager.lockFile = lockFile
+	return nil
+}
+
+func (ipamManager *LocalIpamClient) unlock() {
+	syscall.Flock(int(ipamManager.lockFile.Fd()), syscall.LOCK_UN)
+	ipamManager.lockFile.Close()
+	ipamManager.lockFile = nil
+	fileMutex.Unlock()
+}
+
+// loadDB reads the db, or seeds it from the configured subnet when there is none yet.
+// A JSON db is converted, and written back in the compact format on the next change.
+func (ipamManager *LocalIpamClient) loadDB() (*localIpamDb, error) {
+	content, err := ioutil.ReadFile(ipamManager.Config.IpamDbPath)
+	if os.IsNotExist(err) && ipamManager.Config.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(ipamManager.Config.Subnet)
+		if err != nil {
+			return nil, err
+		}
+
+		db := &localIpamDb{}
+		return db, db.addRange(subnet)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return dbFile, nil
+	return unmarshalLocalIpamDb(content)
 }
 
-func (ipamManager *LocalIpamClient) writeDB(db *LocalIpamConfigFile) error {
-	content, err := json.Marshal(db)
+// writeDB writes then renames, so a crash never leaves a truncated db behind
+func (ipamManager *LocalIpamClient) writeDB(db *localIpamDb) error {
+	path := ipamManager.Config.IpamDbPath
+	err := ioutil.WriteFile(path+".tmp", db.marshal(), 0644)
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(ipamManager.Config.IpamDbPath, content, 0644)
-	if err != nil {
-		return err
+	return os.Rename(path+".tmp", path)
+}
+
+// writeDBWithOwner records the owner of the allocated ip along with the db. The record goes first:
+// one left behind by a failed write only names the owner of a free address.
+func (ipamManager *LocalIpamClient) writeDBWithOwner(db *localIpamDb, ip net.IP) error {
+	if ipamManager.Config.ContainerId != "" {
+		err := os.MkdirAll(ipamManager.ownersDir(), 0755)
+		if err != nil {
+			return err
+		}
+
+		record := ownerRecord(ipamManager.Config.ContainerId, ipamManager.Config.InterfaceName)
+		err = ioutil.WriteFile(filepath.Join(ipamManager.ownersDir(), ip.To4().String()), []byte(record), 0644)
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return ipamManager.writeDB(db)
+}
+
+func (ipamManager *LocalIpamClient) forgetOwner(ip net.IP) {
+	err := os.Remove(filepath.Join(ipamManager.ownersDir(), ip.To4().String()))
+	if err != nil && !os.IsNotExist(err) {
+		ipamManager.Log.Warn(fmt.Sprintf("unable to forget the owner of [%s]: %s", ip, err))
+	}
+}
+
+// ownersDir holds a file per allocated address, named after it, with the container and interface it went to
+func (ipamManager *LocalIpamClient) ownersDir() string {
+	return ipamManager.Config.IpamDbPath + ".owners"
+}
+
+func ownerRecord(containerId string, interfaceName string) string {
+	return containerId + "\n" + interfaceName
 }
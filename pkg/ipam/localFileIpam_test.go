@@ -0,0 +1,187 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLocalIpamClient(t *testing.T) *LocalIpamClient {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	return NewLocalIpamClient(logger, &LocalIpamClientConfig{IpamDbPath: filepath.Join(t.TempDir(), "ipam.db")})
+}
+
+func TestAddRange(t *testing.T) {
+	client := newTestLocalIpamClient(t)
+
+	ranges, free, err := client.Ranges()
+	if err != nil || len(ranges) != 0 || free != 0 {
+		t.Fatalf("expected no range before the db exists, got %v, %d (%v)", ranges, free, err)
+	}
+
+	for _, cidr := range []string{"10.244.0.0/28", "10.244.0.64/28", "10.244.0.0/28"} {
+		err = client.AddRange(mustParseCidr(t, cidr))
+		if err != nil {
+			t.Fatalf("%s: %s", cidr, err)
+		}
+	}
+
+	err = client.AddRange(mustParseCidr(t, "10.244.0.0/27"))
+	if err == nil {
+		t.Fatal("expected an overlapping range to be refused")
+	}
+
+	ranges, free, err = client.Ranges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ranges) != "[10.244.0.0/28 10.244.0.64/28]" || free != 2*14 {
+		t.Fatalf("unexpected ranges %v with %d free", ranges, free)
+	}
+
+	// The gateway comes from the first range
+	gateway, _, err := client.GetGatewayAddress()
+	if err != nil || gateway.String() != "10.244.0.1" {
+		t.Fatalf("expected gateway 10.244.0.1, got %s (%v)", gateway, err)
+	}
+}
+
+func TestReleaseEmptyRange(t *testing.T) {
+	client := newTestLocalIpamClient(t)
+	for _, cidr := range []string{"10.244.0.0/28", "10.244.0.16/28", "10.244.0.32/28"} {
+		err := client.AddRange(mustParseCidr(t, cidr))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, err := client.AllocateStaticIpv4Address(net.ParseIP("10.244.0.20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing any range would leave fewer than 30 free addresses
+	block, err := client.ReleaseEmptyRange(30)
+	if err != nil || block != nil {
+		t.Fatalf("expected the headroom to be kept, got [%s] (%v)", block, err)
+	}
+
+	// The second range holds an allocation, the third goes
+	block, err = client.ReleaseEmptyRange(8)
+	if err != nil || fmt.Sprint(block) != "10.244.0.32/28" {
+		t.Fatalf("expected 10.244.0.32/28 to be released, got [%s] (%v)", block, err)
+	}
+
+	err = client.DeAllocateIpv4Address(net.ParseIP("10.244.0.20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err = client.ReleaseEmptyRange(8)
+	if err != nil || fmt.Sprint(block) != "10.244.0.16/28" {
+		t.Fatalf("expected 10.244.0.16/28 to be released, got [%s] (%v)", block, err)
+	}
+
+	// The first range holds the gateway, it is never released
+	block, err = client.ReleaseEmptyRange(0)
+	if err != nil || block != nil {
+		t.Fatalf("expected the first range to stay, got [%s] (%v)", block, err)
+	}
+
+	ranges, _, err := client.Ranges()
+	if err != nil || fmt.Sprint(ranges) != "[10.244.0.0/28]" {
+		t.Fatalf("unexpected ranges %v (%v)", ranges, err)
+	}
+}
+
+func TestDeAllocateAttachment(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "ipam.db")
+	newClient := func(containerId string, interfaceName string) *LocalIpamClient {
+		return NewLocalIpamClient(logrus.New(), &LocalIpamClientConfig{
+			IpamDbPath:    dbPath,
+			Subnet:        "10.244.0.0/24",
+			ContainerId:   containerId,
+			InterfaceName: interfaceName,
+		})
+	}
+	eth0, net1, other := newClient("c1", "eth0"), newClient("c1", "net1"), newClient("c2", "eth0")
+
+	first, _, err := eth0.AllocateIpv4Address()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = eth0.AllocateStaticIpv4Address(net.ParseIP("10.244.0.100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*LocalIpamClient{net1, other} {
+		_, _, err = client.AllocateIpv4Address()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	released, err := other.DeAllocateAttachment("c1", "eth0")
+	if err != nil || fmt.Sprint(released) != fmt.Sprintf("[%s 10.244.0.100]", first) {
+		t.Fatalf("expected the ips of c1/eth0 to be released, got %v (%v)", released, err)
+	}
+
+	released, err = other.DeAllocateAttachment("c1", "eth0")
+	if err != nil || len(released) != 0 {
+		t.Fatalf("expected nothing left to release, got %v (%v)", released, err)
+	}
+
+	_, free, err := other.Ranges()
+	if err != nil || free != 254-2 {
+		t.Fatalf("expected the ips of c1/net1 and c2/eth0 to stay allocated, got %d free (%v)", free, err)
+	}
+
+	// A release by address forgets the owner as well
+	err = other.DeAllocateIpv4Address(net.ParseIP("10.244.0.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = eth0.AllocateStaticIpv4Address(net.ParseIP("10.244.0.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, err = other.DeAllocateAttachment("c2", "eth0")
+	if err != nil || len(released) != 0 {
+		t.Fatalf("expected c2/eth0 to own nothing anymore, got %v (%v)", released, err)
+	}
+}
+
+func TestAllocateStaticIpv4Address(t *testing.T) {
+	client := NewLocalIpamClient(logrus.New(), &LocalIpamClientConfig{IpamDbPath: filepath.Join(t.TempDir(), "ipam.db"), Subnet: "10.244.0.0/24"})
+	_, _, err := client.GetGatewayAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		ip   string
+		err  error
+	}{
+		{name: "free address", ip: "10.244.0.5"},
+		{name: "same address again", ip: "10.244.0.5", err: ErrIpAlreadyAllocated},
+		{name: "gateway", ip: "10.244.0.1", err: ErrIpAlreadyAllocated},
+		{name: "network address", ip: "10.244.0.0", err: ErrIpOutOfRange},
+		{name: "broadcast address", ip: "10.244.0.255", err: ErrIpOutOfRange},
+		{name: "outside the subnet", ip: "10.244.1.5", err: ErrIpOutOfRange},
+		{name: "last usable address", ip: "10.244.0.254"},
+	} {
+		ip, _, err := client.AllocateStaticIpv4Address(net.ParseIP(test.ip))
+		if test.err == nil && (err != nil || ip.String() != test.ip) {
+			t.Errorf("%s: expected [%s], got [%s] (%v)", test.name, test.ip, ip, err)
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: expected [%s], got %v", test.name, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+)
+
+// localIpamDbMagic starts every db file, followed by localIpamDbVersion
+var localIpamDbMagic = []byte("YIPM")
+
+const localIpamDbVersion = 1
+
+// localIpamDb is the content of the db file. The first range holds the gateway, the next ones are the blocks
+// the router claimed afterwards.
+//
+// On disk, all integers big endian:
+//
+//	magic "YIPM" | version u8 | gateway [4]byte (zero when unset) | range count u16
+//	then per range: network [4]byte | prefix length u8 | cursor u32 | bitmap [size/8]byte
+//
+// A /16 range takes 8KB, against hundreds for the same allocations as JSON.
+type localIpamDb struct {
+	Gateway net.IP
+	Ranges  []*ipRange
+}
+
+// LocalIpamConfigFile is the former JSON db, still read so that existing nodes carry their allocations over.
+// CIDR is the first range, Blocks the ones the router claimed afterwards.
+type LocalIpamConfigFile struct {
+	CIDR           string   `json:"CIDR"`
+	Blocks         []string `json:"Blocks,omitempty"`
+	GatewayAddress string   `json:"gateway,omitempty"`
+	AllocatedIps   []string `json:"AllocatedIps"`
+}
+
+func (db *localIpamDb) addRange(network *net.IPNet) error {
+	for _, r := range db.Ranges {
+		if r.Network.Contains(network.IP) || network.Contains(r.Network.IP) {
+			return fmt.Errorf("range [%s] overlaps [%s]", network, r.Network)
+		}
+	}
+
+	r, err := newIpRange(network)
+	if err != nil {
+		return err
+	}
+
+	db.Ranges = append(db.Ranges, r)
+	return nil
+}
+
+// rangeOf returns the range ip is allocatable in, along with its offset there
+func (db *localIpamDb) rangeOf(ip net.IP) (*ipRange, uint32, bool) {
+	for _, r := range db.Ranges {
+		if offset, ok := r.offset(ip); ok {
+			return r, offset, true
+		}
+	}
+
+	return nil, 0, false
+}
+
+func (db *localIpamDb) free() int {
+	free := 0
+	for _, r := range db.Ranges {
+		free += r.free()
+	}
+
+	return free
+}
+
+func (db *localIpamDb) networks() []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, r := range db.Ranges {
+		networks = append(networks, r.Network)
+	}
+
+	return networks
+}
+
+func (db *localIpamDb) marshal() []byte {
+	buffer := &bytes.Buffer{}
+	buffer.Write(localIpamDbMagic)
+	buffer.WriteByte(localIpamDbVersion)
+
+	gateway := net.IPv4zero.To4()
+	if db.Gateway != nil {
+		gateway = db.Gateway.To4()
+	}
+	buffer.Write(gateway)
+	binary.Write(buffer, binary.BigEndian, uint16(len(db.Ranges)))
+
+	for _, r := range db.Ranges {
+		ones, _ := r.Network.Mask.Size()
+		buffer.Write(r.Network.IP.To4())
+		buffer.WriteByte(byte(ones))
+		binary.Write(buffer, binary.BigEndian, r.Cursor)
+		buffer.Write(r.Bitmap)
+	}
+
+	return buffer.Bytes()
+}
+
+// unmarshalLocalIpamDb reads either format, the JSON one being recognized by its opening brace
+func unmarshalLocalIpamDb(content []byte) (*localIpamDb, error) {
+	if len(bytes.TrimSpace(content)) > 0 && bytes.TrimSpace(content)[0] == '{' {
+		return migrateLocalIpamDb(content)
+	}
+
+	reader := bytes.NewReader(content)
+	header := make([]byte, len(localIpamDbMagic)+1+net.IPv4len)
+	_, err := io.ReadFull(reader, header)
+	if err != nil || !bytes.Equal(header[:len(localIpamDbMagic)], localIpamDbMagic) {
+		return nil, fmt.Errorf("not a yarp ipam db")
+	}
+	if header[len(localIpamDbMagic)] != localIpamDbVersion {
+		return nil, fmt.Errorf("unsupported ipam db version [%d]", header[len(localIpamDbMagic)])
+	}
+
+	db := &localIpamDb{}
+	gateway := net.IP(header[len(localIpamDbMagic)+1:])
+	if !gateway.Equal(net.IPv4zero) {
+		db.Gateway = gateway
+	}
+
+	var count uint16
+	err = binary.Read(reader, binary.BigEndian, &count)
+	if err != nil {
+		return nil, fmt.Errorf("truncated ipam db: %w", err)
+	}
+
+	for i := 0; i < int(count); i++ {
+		network := make([]byte, net.IPv4len+1)
+		_, err = io.ReadFull(reader, network)
+		if err != nil {
+			return nil, fmt.Errorf("truncated ipam db: %w", err)
+		}
+
+		r, err := newIpRange(&net.IPNet{IP: net.IP(network[:net.IPv4len]), Mask: net.CIDRMask(int(network[net.IPv4len]), 32)})
+		if err != nil {
+			return nil, err
+		}
+
+		err = binary.Read(reader, binary.BigEndian, &r.Cursor)
+		if err != nil {
+			return nil, fmt.Errorf("truncated ipam db: %w", err)
+		}
+
+		_, err = io.ReadFull(reader, r.Bitmap)
+		if err != nil {
+			return nil, fmt.Errorf("truncated ipam db: %w", err)
+		}
+
+		db.Ranges = append(db.Ranges, r)
+	}
+
+	return db, nil
+}
+
+// migrateLocalIpamDb converts a JSON db. Cursors start at the highest allocation, as the old allocator filled ranges in order.
+func migrateLocalIpamDb(content []byte) (*localIpamDb, error) {
+	legacy := &LocalIpamConfigFile{}
+	err := json.Unmarshal(content, legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &localIpamDb{}
+	for _, cidr := range append([]string{legacy.CIDR}, legacy.Blocks...) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.addRange(network)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if legacy.GatewayAddress != "" {
+		db.Gateway = net.ParseIP(legacy.GatewayAddress).To4()
+	}
+
+	for _, allocated := range legacy.AllocatedIps {
+		r, offset, ok := db.rangeOf(net.ParseIP(allocated))
+		if !ok {
+			continue
+		}
+
+		r.set(offset)
+		if offset > r.Cursor {
+			r.Cursor = offset
+		}
+	}
+
+	return db, nil
+}
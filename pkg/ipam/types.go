@@ -1,9 +1,23 @@
 package ipam
 
-import "net"
+import (
+	"errors"
+	"net"
+)
+
+var ErrIpAlreadyAllocated = errors.New("ip is already allocated")
+var ErrIpOutOfRange = errors.New("ip is out of the allocatable range")
+var ErrNoFreeIp = errors.New("no free ip left")
 
 type IPAM interface {
 	GetGatewayAddress() (net.IP, *net.IPNet, error)
 	AllocateIpv4Address() (net.IP, *net.IPNet, error)
+	AllocateStaticIpv4Address(net.IP) (net.IP, *net.IPNet, error)
 	DeAllocateIpv4Address(net.IP) error
 }
+
+// AttachmentReleaser is implemented by the IPAMs recording the container and interface every address went to.
+// DEL releases through it when neither the recorded state nor the container interface is left to read the addresses from.
+type AttachmentReleaser interface {
+	DeAllocateAttachment(containerId string, interfaceName string) ([]net.IP, error)
+}
@@ -0,0 +1,57 @@
+package kube
+
+import (
+	"context"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const StaticIpAnnotation = "yarp-cni.io/ip"
+const SysctlsAnnotation = "yarp-cni.io/sysctls"
+const AllowedSourcesAnnotation = "yarp-cni.io/allowed-sources"
+
+// NodeName names the node for the plugin and the router alike, so both find the same keys of the node:
+// the configured name if any, then NODE_NAME, then the hostname kubelet registers the node under by default
+func NodeName(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+
+	if nodeName, ok := os.LookupEnv("NODE_NAME"); ok && nodeName != "" {
+		return nodeName, nil
+	}
+
+	return os.Hostname()
+}
+
+func NewClientset(kubeconfigPath string) (*kubernetes.Clientset, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// NewDynamicClient serves the custom resources of yarp, like the ip pools
+func NewDynamicClient(kubeconfigPath string) (dynamic.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamic.NewForConfig(config)
+}
+
+func GetPodAnnotations(clientset kubernetes.Interface, namespace string, name string) (map[string]string, error) {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return pod.Annotations, nil
+}
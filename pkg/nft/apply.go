@@ -0,0 +1,48 @@
+package nft
+
+import (
+	"github.com/google/nftables"
+)
+
+// Apply replaces the table with the given chains in a single transaction: the table is never seen
+// half programmed, and a failure leaves the previous one in place.
+func Apply(tableName string, chains []*Chain) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+
+	table := &nftables.Table{Name: tableName, Family: nftables.TableFamilyIPv4}
+	// Adding before deleting keeps the deletion from failing when the table does not exist yet
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+
+	for _, chain := range chains {
+		nftChain := &nftables.Chain{
+			Name:  chain.Name,
+			Table: table,
+		}
+		if chain.Hook != nil {
+			policy := nftables.ChainPolicyAccept
+			nftChain.Type = chain.Type
+			nftChain.Hooknum = chain.Hook
+			nftChain.Priority = chain.Priority
+			nftChain.Policy = &policy
+		}
+		conn.AddChain(nftChain)
+	}
+
+	// Rules are added once all chains exist, as they can jump to any of them
+	for _, chain := range chains {
+		for _, exprs := range chain.Rules {
+			conn.AddRule(&nftables.Rule{
+				Table: table,
+				Chain: &nftables.Chain{Name: chain.Name, Table: table},
+				Exprs: exprs,
+			})
+		}
+	}
+
+	return conn.Flush()
+}
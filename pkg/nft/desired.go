@@ -0,0 +1,102 @@
+package nft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"yarp-cni/pkg/cni"
+)
+
+// Desired is everything the yarp table has to implement on the node. The table is always rendered
+// from the whole of it, so the state file is what survives between plugin invocations.
+type Desired struct {
+	// PodSubnet is the single masqueraded subnet of former state files, moved to their endpoints on load
+	PodSubnet string               `json:"podSubnet,omitempty"`
+	Endpoints map[string]*Endpoint `json:"endpoints"`
+}
+
+// Endpoint is one pod interface, keyed by attachment in Desired
+type Endpoint struct {
+	PodIp string `json:"podIp"`
+	// PodSubnet is the network or block of the pod, masqueraded when leaving for anything but a pod of the node
+	PodSubnet    string            `json:"podSubnet,omitempty"`
+	PortMappings []cni.PortMapping `json:"portMappings,omitempty"`
+	// AllowedSources isolates the pod: when set, only these CIDRs can open connections to it
+	AllowedSources []string `json:"allowedSources,omitempty"`
+}
+
+func NewDesired() *Desired {
+	return &Desired{
+		Endpoints: map[string]*Endpoint{},
+	}
+}
+
+// LoadDesired reads the state file, a missing file being an empty state
+func LoadDesired(path string) (*Desired, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewDesired(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	desired := NewDesired()
+	err = json.Unmarshal(content, desired)
+	if err != nil {
+		return nil, err
+	}
+	if desired.Endpoints == nil {
+		desired.Endpoints = map[string]*Endpoint{}
+	}
+
+	if desired.PodSubnet != "" {
+		for _, endpoint := range desired.Endpoints {
+			if endpoint.PodSubnet == "" {
+				endpoint.PodSubnet = desired.PodSubnet
+			}
+		}
+		desired.PodSubnet = ""
+	}
+
+	return desired, nil
+}
+
+func (desired *Desired) Save(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(desired)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path+".tmp", content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// parseCidrs drops nothing silently: a single invalid entry fails the whole list
+func parseCidrs(values []string) ([]*net.IPNet, error) {
+	cidrs := []*net.IPNet{}
+	for _, value := range values {
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			ip := net.ParseIP(value)
+			if ip == nil || ip.To4() == nil {
+				return nil, err
+			}
+			cidr = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
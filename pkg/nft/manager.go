@@ -0,0 +1,96 @@
+package nft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"yarp-cni/pkg/sysctl"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultStatePath keeps the desired state of the node across plugin invocations
+const DefaultStatePath = "/var/lib/cni/yarp/nftables.json"
+
+// Manager keeps the yarp table in line with the endpoints of the node.
+// Every change re-renders and swaps the whole table.
+type Manager struct {
+	StatePath string
+	Log       *logrus.Logger
+}
+
+func NewManager(logger *logrus.Logger, statePath string) *Manager {
+	return &Manager{
+		StatePath: statePath,
+		Log:       logger,
+	}
+}
+
+// AddEndpoint programs the host ports, isolation and masquerading for a pod interface.
+// hostInterfaceName is the interface the pod is reached through, on which route_localnet is enabled
+// so that connections to 127.0.0.1:hostPort can be DNATed.
+func (manager *Manager) AddEndpoint(key string, hostInterfaceName string, endpoint *Endpoint) error {
+	if len(endpoint.PortMappings) > 0 {
+		err := sysctl.Set(fmt.Sprintf("net/ipv4/conf/%s/route_localnet", hostInterfaceName), "1")
+		if err != nil {
+			return err
+		}
+	}
+
+	err := manager.update(func(desired *Desired) {
+		desired.Endpoints[key] = endpoint
+	})
+	if err != nil {
+		return err
+	}
+
+	manager.Log.Info(fmt.Sprintf("Programmed [%d] host ports and [%d] allowed sources for [%s]", len(endpoint.PortMappings), len(endpoint.AllowedSources), key))
+	return nil
+}
+
+// DeleteEndpoint is a no-op for an unknown key. The masquerading of its subnet goes along with its last endpoint.
+func (manager *Manager) DeleteEndpoint(key string) error {
+	return manager.update(func(desired *Desired) {
+		delete(desired.Endpoints, key)
+	})
+}
+
+// update serializes the plugin invocations of the node around the read, apply and write of the state
+func (manager *Manager) update(change func(desired *Desired)) error {
+	err := os.MkdirAll(filepath.Dir(manager.StatePath), 0700)
+	if err != nil {
+		return err
+	}
+
+	lock, err := os.OpenFile(manager.StatePath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	desired, err := LoadDesired(manager.StatePath)
+	if err != nil {
+		return err
+	}
+
+	change(desired)
+
+	chains, err := Render(desired)
+	if err != nil {
+		return err
+	}
+
+	err = Apply(TableName, chains)
+	if err != nil {
+		return fmt.Errorf("unable to program table [%s]: %w", TableName, err)
+	}
+
+	return desired.Save(manager.StatePath)
+}
@@ -0,0 +1,148 @@
+package nft
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// TableName is the table yarp owns. Nothing else is touched, so kube-proxy rules are left alone.
+const TableName = "yarp"
+
+const (
+	preroutingChain  = "prerouting"
+	outputChain      = "output"
+	postroutingChain = "postrouting"
+	forwardChain     = "forward"
+	hostPortsChain   = "hostports"
+)
+
+// Chain is a chain of the yarp table along with its rules. Regular chains have no hook.
+type Chain struct {
+	Name     string
+	Type     nftables.ChainType
+	Hook     *nftables.ChainHook
+	Priority *nftables.ChainPriority
+	Rules    [][]expr.Any
+}
+
+// Render turns the desired state into the chains of the yarp table. It has no side effect, endpoints are
+// rendered in key order so that the same state always yields the same rules.
+func Render(desired *Desired) ([]*Chain, error) {
+	prerouting := &Chain{Name: preroutingChain, Type: nftables.ChainTypeNAT, Hook: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest}
+	output := &Chain{Name: outputChain, Type: nftables.ChainTypeNAT, Hook: nftables.ChainHookOutput, Priority: nftables.ChainPriorityNATDest}
+	postrouting := &Chain{Name: postroutingChain, Type: nftables.ChainTypeNAT, Hook: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource}
+	forward := &Chain{Name: forwardChain, Type: nftables.ChainTypeFilter, Hook: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter}
+	hostPorts := &Chain{Name: hostPortsChain}
+
+	// Host ports are only DNATed for traffic to the node itself
+	prerouting.Rules = append(prerouting.Rules, rule(matchLocalDestination(), jump(hostPortsChain)))
+	output.Rules = append(output.Rules, rule(matchLocalDestination(), jump(hostPortsChain)))
+
+	keys := []string{}
+	for key := range desired.Endpoints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	isolation := [][]expr.Any{}
+	podSubnets := map[string]*net.IPNet{}
+	for _, key := range keys {
+		endpoint := desired.Endpoints[key]
+		podIp := net.ParseIP(endpoint.PodIp).To4()
+		if podIp == nil {
+			return nil, fmt.Errorf("invalid pod ip [%s] for [%s]", endpoint.PodIp, key)
+		}
+		pod := &net.IPNet{IP: podIp, Mask: net.CIDRMask(32, 32)}
+
+		if endpoint.PodSubnet != "" {
+			_, podSubnet, err := net.ParseCIDR(endpoint.PodSubnet)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pod subnet [%s] for [%s]: %w", endpoint.PodSubnet, key, err)
+			}
+			podSubnets[podSubnet.String()] = podSubnet
+		}
+
+		loopback := &net.IPNet{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)}
+
+		for _, mapping := range endpoint.PortMappings {
+			protocol, err := protocolNumber(mapping.Protocol)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port mapping for [%s]: %w", key, err)
+			}
+			err = mapping.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("invalid port mapping for [%s]: %w", key, err)
+			}
+			hostPort, containerPort := uint16(mapping.HostPort), uint16(mapping.ContainerPort)
+
+			dnat := []expr.Any{}
+			if mapping.HostIp != "" && mapping.HostIp != "0.0.0.0" {
+				hostIp := net.ParseIP(mapping.HostIp).To4()
+				if hostIp == nil {
+					return nil, fmt.Errorf("invalid host ip [%s] for [%s]", mapping.HostIp, key)
+				}
+				dnat = matchDestination(&net.IPNet{IP: hostIp, Mask: net.CIDRMask(32, 32)})
+			}
+			hostPorts.Rules = append(hostPorts.Rules, rule(dnat, matchProtocolPort(protocol, hostPort), destinationNat(podIp, containerPort)))
+
+			// Hairpin: the pod reaching itself through the host port
+			postrouting.Rules = append(postrouting.Rules, rule(matchSource(pod), matchDestination(pod), matchProtocolPort(protocol, containerPort), masquerade()))
+			// Localhost: the node reaching the pod through 127.0.0.1:hostPort
+			postrouting.Rules = append(postrouting.Rules, rule(matchSource(loopback), matchDestination(pod), matchProtocolPort(protocol, containerPort), masquerade()))
+		}
+
+		if len(endpoint.AllowedSources) > 0 {
+			sources, err := parseCidrs(endpoint.AllowedSources)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed sources for [%s]: %w", key, err)
+			}
+
+			for _, source := range sources {
+				isolation = append(isolation, rule(matchSource(source), matchDestination(pod), accept()))
+			}
+			isolation = append(isolation, rule(matchDestination(pod), drop()))
+		}
+	}
+
+	if len(isolation) > 0 {
+		// Replies, and connections an isolated pod opened itself, always go through
+		forward.Rules = append(forward.Rules, rule(matchEstablished(), accept()))
+		forward.Rules = append(forward.Rules, isolation...)
+	}
+
+	// One masquerade rule per subnet with pods on the node, traffic between them keeping its source
+	subnets := []string{}
+	for subnet := range podSubnets {
+		subnets = append(subnets, subnet)
+	}
+	sort.Strings(subnets)
+
+	for _, subnet := range subnets {
+		masquerading := [][]expr.Any{matchSource(podSubnets[subnet])}
+		for _, other := range subnets {
+			masquerading = append(masquerading, matchNotDestination(podSubnets[other]))
+		}
+		postrouting.Rules = append(postrouting.Rules, rule(append(masquerading, masquerade())...))
+	}
+
+	return []*Chain{hostPorts, prerouting, output, postrouting, forward}, nil
+}
+
+func protocolNumber(protocol string) (byte, error) {
+	switch strings.ToLower(protocol) {
+	case "", "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	case "sctp":
+		return unix.IPPROTO_SCTP, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol [%s]", protocol)
+	}
+}
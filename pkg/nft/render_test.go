@@ -0,0 +1,188 @@
+package nft
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"yarp-cni/pkg/cni"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func mustParseCidr(t *testing.T, cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return network
+}
+
+func chainRules(t *testing.T, chains []*Chain, name string) [][]expr.Any {
+	for _, chain := range chains {
+		if chain.Name == name {
+			return chain.Rules
+		}
+	}
+
+	t.Fatalf("no chain [%s]", name)
+	return nil
+}
+
+func TestRender(t *testing.T) {
+	pod := func(ip string) *net.IPNet {
+		return &net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	loopback := pod("127.0.0.1")
+
+	for _, test := range []struct {
+		name      string
+		endpoints map[string]*Endpoint
+		expected  map[string][][]expr.Any
+		err       string
+	}{
+		{
+			name:      "no endpoint",
+			endpoints: map[string]*Endpoint{},
+			expected: map[string][][]expr.Any{
+				hostPortsChain:   nil,
+				postroutingChain: nil,
+				forwardChain:     nil,
+			},
+		},
+		{
+			name: "host ports",
+			endpoints: map[string]*Endpoint{
+				"c1/eth0": {PodIp: "10.244.0.2", PortMappings: []cni.PortMapping{
+					{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+					{HostPort: 5353, ContainerPort: 53, Protocol: "udp", HostIp: "10.0.0.1"},
+				}},
+			},
+			expected: map[string][][]expr.Any{
+				hostPortsChain: {
+					rule(matchProtocolPort(unix.IPPROTO_TCP, 8080), destinationNat(net.ParseIP("10.244.0.2"), 80)),
+					rule(matchDestination(pod("10.0.0.1")), matchProtocolPort(unix.IPPROTO_UDP, 5353), destinationNat(net.ParseIP("10.244.0.2"), 53)),
+				},
+				postroutingChain: {
+					rule(matchSource(pod("10.244.0.2")), matchDestination(pod("10.244.0.2")), matchProtocolPort(unix.IPPROTO_TCP, 80), masquerade()),
+					rule(matchSource(loopback), matchDestination(pod("10.244.0.2")), matchProtocolPort(unix.IPPROTO_TCP, 80), masquerade()),
+					rule(matchSource(pod("10.244.0.2")), matchDestination(pod("10.244.0.2")), matchProtocolPort(unix.IPPROTO_UDP, 53), masquerade()),
+					rule(matchSource(loopback), matchDestination(pod("10.244.0.2")), matchProtocolPort(unix.IPPROTO_UDP, 53), masquerade()),
+				},
+				forwardChain: nil,
+			},
+		},
+		{
+			name: "isolation",
+			endpoints: map[string]*Endpoint{
+				"c2/eth0": {PodIp: "10.244.0.3"},
+				"c1/eth0": {PodIp: "10.244.0.2", AllowedSources: []string{"10.0.0.0/8", "192.168.1.1"}},
+			},
+			expected: map[string][][]expr.Any{
+				hostPortsChain:   nil,
+				postroutingChain: nil,
+				forwardChain: {
+					rule(matchEstablished(), accept()),
+					rule(matchSource(mustParseCidr(t, "10.0.0.0/8")), matchDestination(pod("10.244.0.2")), accept()),
+					rule(matchSource(pod("192.168.1.1")), matchDestination(pod("10.244.0.2")), accept()),
+					rule(matchDestination(pod("10.244.0.2")), drop()),
+				},
+			},
+		},
+		{
+			name: "masquerade per subnet",
+			endpoints: map[string]*Endpoint{
+				"c1/eth0": {PodIp: "10.244.0.2", PodSubnet: "10.244.0.0/26"},
+				"c2/eth0": {PodIp: "10.244.0.3", PodSubnet: "10.244.0.0/26"},
+				"c3/net1": {PodIp: "10.245.0.2", PodSubnet: "10.245.0.0/24"},
+			},
+			expected: map[string][][]expr.Any{
+				hostPortsChain: nil,
+				postroutingChain: {
+					rule(matchSource(mustParseCidr(t, "10.244.0.0/26")), matchNotDestination(mustParseCidr(t, "10.244.0.0/26")), matchNotDestination(mustParseCidr(t, "10.245.0.0/24")), masquerade()),
+					rule(matchSource(mustParseCidr(t, "10.245.0.0/24")), matchNotDestination(mustParseCidr(t, "10.244.0.0/26")), matchNotDestination(mustParseCidr(t, "10.245.0.0/24")), masquerade()),
+				},
+				forwardChain: nil,
+			},
+		},
+		{
+			name:      "invalid pod ip",
+			endpoints: map[string]*Endpoint{"c1/eth0": {PodIp: "fd00::2"}},
+			err:       "invalid pod ip",
+		},
+		{
+			name:      "invalid protocol",
+			endpoints: map[string]*Endpoint{"c1/eth0": {PodIp: "10.244.0.2", PortMappings: []cni.PortMapping{{HostPort: 80, ContainerPort: 80, Protocol: "icmp"}}}},
+			err:       "unknown protocol",
+		},
+		{
+			name:      "host port out of range",
+			endpoints: map[string]*Endpoint{"c1/eth0": {PodIp: "10.244.0.2", PortMappings: []cni.PortMapping{{HostPort: 65616, ContainerPort: 80, Protocol: "tcp"}}}},
+			err:       "invalid host port [65616]",
+		},
+		{
+			name:      "no container port",
+			endpoints: map[string]*Endpoint{"c1/eth0": {PodIp: "10.244.0.2", PortMappings: []cni.PortMapping{{HostPort: 8080, Protocol: "tcp"}}}},
+			err:       "invalid container port [0]",
+		},
+		{
+			name:      "invalid allowed source",
+			endpoints: map[string]*Endpoint{"c1/eth0": {PodIp: "10.244.0.2", AllowedSources: []string{"10.0.0.0/8", "nope"}}},
+			err:       "invalid allowed sources",
+		},
+	} {
+		chains, err := Render(&Desired{Endpoints: test.endpoints})
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error [%s], got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		for chain, expected := range test.expected {
+			rules := chainRules(t, chains, chain)
+			if len(rules) != len(expected) || (len(expected) > 0 && !reflect.DeepEqual(rules, expected)) {
+				t.Errorf("%s: unexpected rules in chain [%s]: got %d, expected %d", test.name, chain, len(rules), len(expected))
+			}
+		}
+	}
+}
+
+func TestLoadDesiredMovesPodSubnetToEndpoints(t *testing.T) {
+	path := t.TempDir() + "/nftables.json"
+	legacy := &Desired{
+		PodSubnet: "10.244.0.0/24",
+		Endpoints: map[string]*Endpoint{
+			"c1/eth0": {PodIp: "10.244.0.2"},
+			"c2/net1": {PodIp: "10.245.0.2", PodSubnet: "10.245.0.0/24"},
+		},
+	}
+	err := legacy.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	desired, err := LoadDesired(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desired.PodSubnet != "" || desired.Endpoints["c1/eth0"].PodSubnet != "10.244.0.0/24" || desired.Endpoints["c2/net1"].PodSubnet != "10.245.0.0/24" {
+		t.Fatalf("unexpected state %+v", desired)
+	}
+
+	// Once its last endpoint is gone, the subnet is no longer masqueraded
+	delete(desired.Endpoints, "c1/eth0")
+	chains, err := Render(desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chainRules(t, chains, postroutingChain)) != 1 {
+		t.Fatalf("expected a single masquerade rule, got %d", len(chainRules(t, chains, postroutingChain)))
+	}
+}
@@ -0,0 +1,205 @@
+package nft
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// ServicesTableName is the table of the service proxy, kept apart from the one the plugin owns
+const ServicesTableName = "yarp_services"
+
+// masqueradeMark flags connections that must be masqueraded once load balanced: node ports spread across
+// the cluster, whose replies must come back through this node, and pods reaching themselves through their service
+const masqueradeMark = 0x4000
+
+const (
+	servicesChain        = "services"
+	serviceChainPrefix   = "svc-"
+	endpointChainPrefix  = "sep-"
+	servicesPriorityBase = -110 // Before the host ports of the plugin table
+)
+
+// Service is one port of a Kubernetes Service along with the ready endpoints behind it
+type Service struct {
+	// Name identifies the service port, e.g. namespace/name:port
+	Name      string
+	ClusterIp string
+	Port      int
+	NodePort  int
+	Protocol  string
+	Endpoints []ServiceEndpoint
+	// NodePortEndpoints, when set, restricts node port traffic to these endpoints, e.g. the ones of this node
+	// for externalTrafficPolicy: Local
+	NodePortEndpoints []ServiceEndpoint
+}
+
+type ServiceEndpoint struct {
+	Ip   string
+	Port int
+}
+
+// RenderServices turns the services into the chains of the services table. Like Render, it has no side effect
+// and yields the same rules for the same services, whatever their order.
+//
+// Every service port gets a chain spreading connections across its endpoint chains, each one picked with
+// probability 1/(remaining endpoints) so that they all end up with the same share.
+func RenderServices(services []*Service) ([]*Chain, error) {
+	dstnatPriority := nftables.ChainPriorityRef(servicesPriorityBase)
+	prerouting := &Chain{Name: preroutingChain, Type: nftables.ChainTypeNAT, Hook: nftables.ChainHookPrerouting, Priority: dstnatPriority}
+	output := &Chain{Name: outputChain, Type: nftables.ChainTypeNAT, Hook: nftables.ChainHookOutput, Priority: dstnatPriority}
+	postrouting := &Chain{Name: postroutingChain, Type: nftables.ChainTypeNAT, Hook: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource}
+	dispatch := &Chain{Name: servicesChain}
+
+	prerouting.Rules = append(prerouting.Rules, rule(jump(servicesChain)))
+	output.Rules = append(output.Rules, rule(jump(servicesChain)))
+	postrouting.Rules = append(postrouting.Rules, rule(matchMark(masqueradeMark), masquerade()))
+
+	sorted := append([]*Service{}, services...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	chains := []*Chain{}
+	endpointChains := map[string]*Chain{}
+	nodePorts := [][]expr.Any{}
+	for _, service := range sorted {
+		protocol, err := protocolNumber(service.Protocol)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service [%s]: %w", service.Name, err)
+		}
+
+		clusterIp := net.ParseIP(service.ClusterIp).To4()
+		if clusterIp == nil {
+			return nil, fmt.Errorf("invalid cluster ip [%s] for service [%s]", service.ClusterIp, service.Name)
+		}
+
+		port, err := servicePort(service.Port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service [%s]: %w", service.Name, err)
+		}
+
+		serviceChain, err := loadBalancingChain(serviceChainPrefix+chainSuffix(service.Name), protocol, service.Endpoints, endpointChains)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoints for service [%s]: %w", service.Name, err)
+		}
+		chains = append(chains, serviceChain)
+		dispatch.Rules = append(dispatch.Rules, rule(
+			matchDestination(&net.IPNet{IP: clusterIp, Mask: net.CIDRMask(32, 32)}),
+			matchProtocolPort(protocol, port),
+			jump(serviceChain.Name)))
+
+		if service.NodePort == 0 {
+			continue
+		}
+		nodePort, err := servicePort(service.NodePort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node port of service [%s]: %w", service.Name, err)
+		}
+
+		// Endpoints restricted to this node reply through it anyway, so the client source is kept
+		if service.NodePortEndpoints == nil {
+			nodePorts = append(nodePorts, rule(matchProtocolPort(protocol, nodePort), setMark(masqueradeMark)))
+			nodePorts = append(nodePorts, rule(matchProtocolPort(protocol, nodePort), jump(serviceChain.Name)))
+			continue
+		}
+
+		nodePortChain, err := loadBalancingChain(serviceChainPrefix+chainSuffix(service.Name+"/nodeport"), protocol, service.NodePortEndpoints, endpointChains)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node port endpoints for service [%s]: %w", service.Name, err)
+		}
+		chains = append(chains, nodePortChain)
+		nodePorts = append(nodePorts, rule(matchProtocolPort(protocol, nodePort), jump(nodePortChain.Name)))
+	}
+
+	// Node ports come last, behind a single check that the traffic is for the node itself
+	if len(nodePorts) > 0 {
+		nodePortsChain := &Chain{Name: "nodeports", Rules: nodePorts}
+		chains = append(chains, nodePortsChain)
+		dispatch.Rules = append(dispatch.Rules, rule(matchLocalDestination(), jump(nodePortsChain.Name)))
+	}
+
+	endpointNames := []string{}
+	for name := range endpointChains {
+		endpointNames = append(endpointNames, name)
+	}
+	sort.Strings(endpointNames)
+	for _, name := range endpointNames {
+		chains = append(chains, endpointChains[name])
+	}
+
+	return append(chains, dispatch, prerouting, output, postrouting), nil
+}
+
+// loadBalancingChain spreads connections across the endpoints, whose chains are added to endpointChains.
+// Endpoints are taken in address order, whatever the order they are listed in. Connections to a service
+// without endpoints are dropped.
+func loadBalancingChain(name string, protocol byte, endpoints []ServiceEndpoint, endpointChains map[string]*Chain) (*Chain, error) {
+	endpoints = append([]ServiceEndpoint{}, endpoints...)
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Ip != endpoints[j].Ip {
+			return endpoints[i].Ip < endpoints[j].Ip
+		}
+		return endpoints[i].Port < endpoints[j].Port
+	})
+
+	chain := &Chain{Name: name}
+	for i, endpoint := range endpoints {
+		endpointChain, err := serviceEndpointChain(protocol, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		endpointChains[endpointChain.Name] = endpointChain
+
+		remaining := uint32(len(endpoints) - i)
+		if remaining == 1 {
+			chain.Rules = append(chain.Rules, rule(jump(endpointChain.Name)))
+		} else {
+			chain.Rules = append(chain.Rules, rule(matchRandom(remaining), jump(endpointChain.Name)))
+		}
+	}
+
+	if len(endpoints) == 0 {
+		chain.Rules = append(chain.Rules, rule(drop()))
+	}
+
+	return chain, nil
+}
+
+// serviceEndpointChain DNATs to the endpoint, flagging the pod reaching itself for masquerading
+func serviceEndpointChain(protocol byte, endpoint ServiceEndpoint) (*Chain, error) {
+	ip := net.ParseIP(endpoint.Ip).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid endpoint ip [%s]", endpoint.Ip)
+	}
+	port, err := servicePort(endpoint.Port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint [%s]: %w", endpoint.Ip, err)
+	}
+
+	destination := net.JoinHostPort(ip.String(), fmt.Sprint(endpoint.Port))
+	return &Chain{
+		Name: endpointChainPrefix + chainSuffix(fmt.Sprintf("%d/%s", protocol, destination)),
+		Rules: [][]expr.Any{
+			rule(matchSource(&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}), setMark(masqueradeMark)),
+			rule(matchProtocol(protocol), destinationNat(ip, port)),
+		},
+	}, nil
+}
+
+// servicePort refuses ports out of 1-65535, which would wrap around to another port once in a rule
+func servicePort(port int) (uint16, error) {
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port [%d]", port)
+	}
+
+	return uint16(port), nil
+}
+
+// chainSuffix derives a stable and short chain name from what the chain stands for
+func chainSuffix(name string) string {
+	return strings.ToUpper(fmt.Sprintf("%x", sha1.Sum([]byte(name)))[:16])
+}
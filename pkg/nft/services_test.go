@@ -0,0 +1,153 @@
+package nft
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func findChain(chains []*Chain, name string) *Chain {
+	for _, chain := range chains {
+		if chain.Name == name {
+			return chain
+		}
+	}
+
+	return nil
+}
+
+func TestRenderServicesProbabilityLadder(t *testing.T) {
+	endpoints := []ServiceEndpoint{{Ip: "10.244.0.4", Port: 8080}, {Ip: "10.244.0.2", Port: 8080}, {Ip: "10.244.0.3", Port: 8080}}
+	chains, err := RenderServices([]*Service{{Name: "default/web:http", ClusterIp: "10.96.0.10", Port: 80, Protocol: "tcp", Endpoints: endpoints}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serviceChain := findChain(chains, serviceChainPrefix+chainSuffix("default/web:http"))
+	if serviceChain == nil {
+		t.Fatal("no chain for the service")
+	}
+
+	// Each endpoint is picked with probability 1/(remaining endpoints), in address order
+	expected := [][]expr.Any{}
+	for i, ip := range []string{"10.244.0.2", "10.244.0.3", "10.244.0.4"} {
+		endpointChain, err := serviceEndpointChain(unix.IPPROTO_TCP, ServiceEndpoint{Ip: ip, Port: 8080})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if findChain(chains, endpointChain.Name) == nil {
+			t.Fatalf("no chain for endpoint [%s]", ip)
+		}
+
+		if remaining := uint32(3 - i); remaining > 1 {
+			expected = append(expected, rule(matchRandom(remaining), jump(endpointChain.Name)))
+		} else {
+			expected = append(expected, rule(jump(endpointChain.Name)))
+		}
+	}
+	if !reflect.DeepEqual(serviceChain.Rules, expected) {
+		t.Fatalf("unexpected load balancing rules %v", serviceChain.Rules)
+	}
+
+	dispatch := findChain(chains, servicesChain)
+	clusterIp := &net.IPNet{IP: net.ParseIP("10.96.0.10").To4(), Mask: net.CIDRMask(32, 32)}
+	if len(dispatch.Rules) != 1 || !reflect.DeepEqual(dispatch.Rules[0], rule(matchDestination(clusterIp), matchProtocolPort(unix.IPPROTO_TCP, 80), jump(serviceChain.Name))) {
+		t.Fatalf("unexpected dispatch rules %v", dispatch.Rules)
+	}
+}
+
+func TestRenderServicesWithoutEndpointsDrops(t *testing.T) {
+	chains, err := RenderServices([]*Service{{Name: "default/empty:http", ClusterIp: "10.96.0.11", Port: 80, NodePort: 30080, Protocol: "tcp", NodePortEndpoints: []ServiceEndpoint{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"default/empty:http", "default/empty:http/nodeport"} {
+		chain := findChain(chains, serviceChainPrefix+chainSuffix(name))
+		if chain == nil || !reflect.DeepEqual(chain.Rules, [][]expr.Any{rule(drop())}) {
+			t.Fatalf("expected [%s] to drop connections, got %v", name, chain)
+		}
+	}
+}
+
+func TestRenderServicesNodePortMasquerading(t *testing.T) {
+	endpoints := []ServiceEndpoint{{Ip: "10.244.0.2", Port: 8080}}
+	for _, test := range []struct {
+		name              string
+		nodePortEndpoints []ServiceEndpoint
+		masqueraded       bool
+	}{
+		{name: "cluster", nodePortEndpoints: nil, masqueraded: true},
+		{name: "local", nodePortEndpoints: endpoints, masqueraded: false},
+		{name: "local without endpoints", nodePortEndpoints: []ServiceEndpoint{}, masqueraded: false},
+	} {
+		chains, err := RenderServices([]*Service{{Name: "default/web:http", ClusterIp: "10.96.0.10", Port: 80, NodePort: 30080, Protocol: "tcp", Endpoints: endpoints, NodePortEndpoints: test.nodePortEndpoints}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nodePorts := findChain(chains, "nodeports")
+		if nodePorts == nil {
+			t.Fatalf("%s: no node ports chain", test.name)
+		}
+
+		masqueraded := false
+		for _, nodePortRule := range nodePorts.Rules {
+			if reflect.DeepEqual(nodePortRule, rule(matchProtocolPort(unix.IPPROTO_TCP, 30080), setMark(masqueradeMark))) {
+				masqueraded = true
+			}
+		}
+		if masqueraded != test.masqueraded {
+			t.Errorf("%s: expected node port masquerading to be %t", test.name, test.masqueraded)
+		}
+	}
+}
+
+func TestRenderServicesOrderingIsStable(t *testing.T) {
+	services := []*Service{
+		{Name: "default/web:http", ClusterIp: "10.96.0.10", Port: 80, NodePort: 30080, Protocol: "tcp", Endpoints: []ServiceEndpoint{{Ip: "10.244.0.3", Port: 8080}, {Ip: "10.244.0.2", Port: 8080}}},
+		{Name: "kube-system/dns:dns", ClusterIp: "10.96.0.2", Port: 53, Protocol: "udp", Endpoints: []ServiceEndpoint{{Ip: "10.244.1.2", Port: 53}, {Ip: "10.244.0.5", Port: 53}}},
+		{Name: "default/api:https", ClusterIp: "10.96.0.1", Port: 443, Protocol: "tcp", Endpoints: []ServiceEndpoint{{Ip: "10.0.0.1", Port: 6443}}},
+	}
+	reordered := []*Service{
+		{Name: "kube-system/dns:dns", ClusterIp: "10.96.0.2", Port: 53, Protocol: "udp", Endpoints: []ServiceEndpoint{{Ip: "10.244.0.5", Port: 53}, {Ip: "10.244.1.2", Port: 53}}},
+		services[2],
+		{Name: "default/web:http", ClusterIp: "10.96.0.10", Port: 80, NodePort: 30080, Protocol: "tcp", Endpoints: []ServiceEndpoint{{Ip: "10.244.0.2", Port: 8080}, {Ip: "10.244.0.3", Port: 8080}}},
+	}
+
+	chains, err := RenderServices(services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reorderedChains, err := RenderServices(reordered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(chains, reorderedChains) {
+		t.Fatal("expected the same chains whatever the order of services and endpoints")
+	}
+}
+
+func TestRenderServicesRefusesPortsOutOfRange(t *testing.T) {
+	endpoints := []ServiceEndpoint{{Ip: "10.244.0.2", Port: 8080}}
+	for _, test := range []struct {
+		name    string
+		service *Service
+		err     string
+	}{
+		{name: "service port wrapping to 80", service: &Service{Name: "default/web:http", ClusterIp: "10.96.0.10", Port: 65616, Protocol: "tcp", Endpoints: endpoints}, err: "invalid port [65616]"},
+		{name: "no service port", service: &Service{Name: "default/web:http", ClusterIp: "10.96.0.10", Protocol: "tcp", Endpoints: endpoints}, err: "invalid port [0]"},
+		{name: "negative node port", service: &Service{Name: "default/web:http", ClusterIp: "10.96.0.10", Port: 80, NodePort: -1, Protocol: "tcp", Endpoints: endpoints}, err: "invalid node port"},
+		{name: "endpoint port too large", service: &Service{Name: "default/web:http", ClusterIp: "10.96.0.10", Port: 80, Protocol: "tcp", Endpoints: []ServiceEndpoint{{Ip: "10.244.0.2", Port: 70000}}}, err: "invalid port [70000]"},
+	} {
+		_, err := RenderServices([]*Service{test.service})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected [%s], got %v", test.name, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package portmap
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"yarp-cni/pkg/cni"
+
+	"github.com/sirupsen/logrus"
+)
+
+const natTable = "nat"
+const hostPortDnatChain = "YARP-HOSTPORT-DNAT"
+const hostPortMasqChain = "YARP-HOSTPORT-MASQ"
+const containerDnatChainPrefix = "YARP-DN-"
+const containerMasqChainPrefix = "YARP-SN-"
+
+// PortMapper programs hostPort DNAT rules with iptables.
+// Every container gets its own pair of chains, named after its id, so they can be removed without knowing the pod ip.
+type PortMapper struct {
+	Log *logrus.Logger
+}
+
+func NewPortMapper(logger *logrus.Logger) *PortMapper {
+	return &PortMapper{
+		Log: logger,
+	}
+}
+
+// AddMappings forwards each host port to the pod ip. hostInterfaceName is the interface pods are reached through,
+// on which route_localnet is enabled so that connections to 127.0.0.1:hostPort can be DNATed.
+func (pm *PortMapper) AddMappings(containerId string, podIp net.IP, hostInterfaceName string, mappings []cni.PortMapping) error {
+	// Nothing is programmed unless every mapping is valid
+	for _, mapping := range mappings {
+		err := mapping.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Leftovers of a previous attempt for the same container are dropped first
+	err := pm.DeleteMappings(containerId)
+	if err != nil {
+		return err
+	}
+
+	err = pm.ensureTopLevelChains()
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", hostInterfaceName), []byte("1"), 0644)
+	if err != nil {
+		return err
+	}
+
+	dnatChain, masqChain := containerChains(containerId)
+	for _, chain := range []string{dnatChain, masqChain} {
+		err = pm.iptables("-t", natTable, "-N", chain)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, mapping := range mappings {
+		protocol := strings.ToLower(mapping.Protocol)
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		hostPort := strconv.Itoa(mapping.HostPort)
+		containerPort := strconv.Itoa(mapping.ContainerPort)
+		destination := net.JoinHostPort(podIp.String(), containerPort)
+
+		dnatRule := []string{"-t", natTable, "-A", dnatChain, "-p", protocol, "--dport", hostPort}
+		if mapping.HostIp != "" && mapping.HostIp != "0.0.0.0" {
+			dnatRule = append(dnatRule, "-d", mapping.HostIp)
+		}
+		dnatRule = append(dnatRule, "-j", "DNAT", "--to-destination", destination)
+		err = pm.iptables(dnatRule...)
+		if err != nil {
+			return err
+		}
+
+		// Hairpin: the pod reaching itself through the host port
+		err = pm.iptables("-t", natTable, "-A", masqChain, "-p", protocol, "-s", podIp.String(), "-d", podIp.String(), "--dport", containerPort, "-j", "MASQUERADE")
+		if err != nil {
+			return err
+		}
+
+		// Localhost: the node reaching the pod through 127.0.0.1:hostPort
+		err = pm.iptables("-t", natTable, "-A", masqChain, "-p", protocol, "-s", "127.0.0.1", "-d", podIp.String(), "--dport", containerPort, "-j", "MASQUERADE")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = pm.iptables("-t", natTable, "-A", hostPortDnatChain, "-m", "comment", "--comment", containerId, "-j", dnatChain)
+	if err != nil {
+		return err
+	}
+
+	err = pm.iptables("-t", natTable, "-A", hostPortMasqChain, "-m", "comment", "--comment", containerId, "-j", masqChain)
+	if err != nil {
+		return err
+	}
+
+	pm.Log.Info(fmt.Sprintf("Mapped [%d] host ports to [%s] for container [%s]", len(mappings), podIp, containerId))
+	return nil
+}
+
+// DeleteMappings removes the chains of the container. It is a no-op if the container never had any port mapped.
+func (pm *PortMapper) DeleteMappings(containerId string) error {
+	dnatChain, masqChain := containerChains(containerId)
+
+	for _, chains := range [][]string{{hostPortDnatChain, dnatChain}, {hostPortMasqChain, masqChain}} {
+		parentChain, chain := chains[0], chains[1]
+		if !pm.chainExists(chain) {
+			continue
+		}
+
+		if pm.chainExists(parentChain) {
+			// Ignore failures, the jump might not have been created if a previous ADD failed half way
+			_ = pm.iptables("-t", natTable, "-D", parentChain, "-m", "comment", "--comment", containerId, "-j", chain)
+		}
+
+		err := pm.iptables("-t", natTable, "-F", chain)
+		if err != nil {
+			return err
+		}
+
+		err = pm.iptables("-t", natTable, "-X", chain)
+		if err != nil {
+			return err
+		}
+		pm.Log.Debug(fmt.Sprintf("Deleted chain [%s] of container [%s]", chain, containerId))
+	}
+
+	return nil
+}
+
+func (pm *PortMapper) ensureTopLevelChains() error {
+	jumps := []struct {
+		parent string
+		chain  string
+		match  []string
+	}{
+		{parent: "PREROUTING", chain: hostPortDnatChain, match: []string{"-m", "addrtype", "--dst-type", "LOCAL"}},
+		{parent: "OUTPUT", chain: hostPortDnatChain, match: []string{"-m", "addrtype", "--dst-type", "LOCAL"}},
+		{parent: "POSTROUTING", chain: hostPortMasqChain, match: []string{}},
+	}
+
+	for _, jump := range jumps {
+		if !pm.chainExists(jump.chain) {
+			err := pm.iptables("-t", natTable, "-N", jump.chain)
+			if err != nil {
+				return err
+			}
+		}
+
+		rule := append(jump.match, "-j", jump.chain)
+		err := pm.iptables(append([]string{"-t", natTable, "-C", jump.parent}, rule...)...)
+		if err == nil {
+			continue
+		}
+
+		err = pm.iptables(append([]string{"-t", natTable, "-A", jump.parent}, rule...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pm *PortMapper) chainExists(chain string) bool {
+	return pm.iptables("-t", natTable, "-S", chain) == nil
+}
+
+func (pm *PortMapper) iptables(args ...string) error {
+	output, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s failed with [%s]: %w", strings.Join(args, " "), strings.TrimSpace(string(output)), err)
+	}
+
+	return nil
+}
+
+// containerChains derives stable chain names from the container id, within the 28 chars iptables allows
+func containerChains(containerId string) (string, string) {
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(containerId)))[:16]
+	return containerDnatChainPrefix + strings.ToUpper(hash), containerMasqChainPrefix + strings.ToUpper(hash)
+}
@@ -1,59 +1,489 @@
 package router
 
-//iptables -t nat -A POSTROUTING -s 10.244.1.0/24 -j MASQUERADE
-
 import (
 	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+	"yarp-cni/pkg/ipam"
 
 	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
-func NewRouteController(log *logrus.Logger, nodeName string) error {
-	//kubernetesEndpoint := "https://192.168.1.84:6443"
-	namespaceName := "kube-system"
-	routingTableConfigMapName := "yarp-routing-table"
-	podSubnet := "10.244.0.0/24"
-
-	config, _ := clientcmd.BuildConfigFromFlags("", "/root/.kube/config")
-	clientset, _ := kubernetes.NewForConfig(config)
-
-	routingTable, err := clientset.CoreV1().ConfigMaps(namespaceName).Get(context.Background(), routingTableConfigMapName, metav1.GetOptions{})
-	if errors.IsNotFound(err) {
-		configMapData := make(map[string]string, 0)
-		configMapData[nodeName] = podSubnet
-		configMap := corev1.ConfigMap{
-			TypeMeta: metav1.TypeMeta{
-				Kind:       "ConfigMap",
-				APIVersion: "v1",
-			},
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      routingTableConfigMapName,
-				Namespace: namespaceName,
-			},
-		}
-		_, err := clientset.CoreV1().ConfigMaps(namespaceName).Create(context.Background(), &configMap, metav1.CreateOptions{})
-		if err != nil {
-			log.Errorf("unable to create configmap [%s]", routingTableConfigMapName)
+const kubeconfigPath = "/root/.kube/config"
+
+const routingTableNamespace = "kube-system"
+const routingTableConfigMapName = "yarp-routing-table"
+
+const DefaultClusterPool = "10.244.0.0/16"
+const DefaultBlockSize = 26
+
+// minFreeIps is the headroom below which the node claims one more block
+const minFreeIps = 8
+
+const syncPeriod = 10 * time.Second
+
+// routeProtocol tags the routes of the router, so stale ones can be told apart from everybody else's
+const routeProtocol = 0xb1
+
+// NewClientset is shared by the components of the router
+func NewClientset() (*kubernetes.Clientset, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// NewDynamicClient reads the custom resources of yarp, like the ip pools
+func NewDynamicClient() (dynamic.Interface, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamic.NewForConfig(config)
+}
+
+// RouteController hands out blocks of the cluster pool to the local IPAM as it fills up, and gives empty ones back.
+// Owned blocks are published in the yarp-routing-table ConfigMap as a comma separated list per node,
+// from which every node routes the blocks of its peers through their InternalIP. The blocks of deleted
+// nodes are taken out of the ConfigMap, for other nodes to claim.
+type RouteController struct {
+	NodeName   string
+	Clientset  kubernetes.Interface
+	Nodes      corelisters.NodeLister
+	Pool       *net.IPNet
+	BlockSize  int
+	BridgeName string
+	Ipam       *ipam.LocalIpamClient
+	// BlockSources list blocks nodes own outside of the routing table, which get routed too
+	BlockSources []BlockSource
+	Log          *logrus.Logger
+
+	factory informers.SharedInformerFactory
+}
+
+// BlockSource lists blocks by node, like those the etcd and crd ipams hand out
+type BlockSource interface {
+	NodeBlocks() (map[string][]*net.IPNet, error)
+}
+
+func NewRouteController(log *logrus.Logger, clientset kubernetes.Interface, nodeName string, pool string, blockSize int, ipamDbPath string, bridgeName string) (*RouteController, error) {
+	_, poolNet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster pool [%s]: %w", pool, err)
+	}
+
+	ones, _ := poolNet.Mask.Size()
+	if blockSize < ones || blockSize > 30 {
+		return nil, fmt.Errorf("block size [/%d] does not fit in cluster pool [%s]", blockSize, pool)
+	}
+
+	factory := informers.NewSharedInformerFactory(clientset, resyncPeriod)
+
+	return &RouteController{
+		NodeName:   nodeName,
+		Clientset:  clientset,
+		Nodes:      factory.Core().V1().Nodes().Lister(),
+		Pool:       poolNet,
+		BlockSize:  blockSize,
+		BridgeName: bridgeName,
+		Ipam: ipam.NewLocalIpamClient(log, &ipam.LocalIpamClientConfig{
+			IpamDbPath: ipamDbPath,
+		}),
+		Log:     log,
+		factory: factory,
+	}, nil
+}
+
+// Run syncs blocks and routes until stopCh is closed
+func (rc *RouteController) Run(stopCh <-chan struct{}) error {
+	rc.factory.Start(stopCh)
+	for informer, synced := range rc.factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("unable to sync informer [%s]", informer)
+		}
+	}
+
+	rc.Log.Infof("Route controller started on node [%s] with pool [%s]", rc.NodeName, rc.Pool)
+	wait.Until(func() {
+		err := rc.sync()
+		if err != nil {
+			rc.Log.Errorf("unable to sync routes: %s", err)
+		}
+	}, syncPeriod, stopCh)
+
+	return nil
+}
+
+func (rc *RouteController) sync() error {
+	ranges, free, err := rc.Ipam.Ranges()
+	if err != nil {
+		return err
+	}
+
+	if free < minFreeIps {
+		block, err := rc.claimBlock(ranges)
+		if err != nil {
+			return err
+		}
+
+		err = rc.Ipam.AddRange(block)
+		if err != nil {
 			return err
 		}
+	} else {
+		// Keep the headroom so that the block is not claimed again right away
+		for {
+			block, err := rc.Ipam.ReleaseEmptyRange(minFreeIps)
+			if err != nil {
+				return err
+			}
+			if block == nil {
+				break
+			}
+		}
+	}
+
+	// Claims and releases only reach the ConfigMap through the db, which stays the reference
+	ranges, _, err = rc.Ipam.Ranges()
+	if err != nil {
+		return err
+	}
+
+	routingTable, err := rc.publishRanges(ranges)
+	if err != nil {
+		return err
+	}
+
+	blocksByNode := map[string][]*net.IPNet{}
+	for node, cidrs := range routingTable {
+		blocks, err := parseBlocks(cidrs)
+		if err != nil {
+			rc.Log.Warnf("invalid blocks of node [%s]: %s", node, err)
+			continue
+		}
+		blocksByNode[node] = blocks
 	}
 
-	//Check if node is present
-	_, ok := routingTable.Data[nodeName]
-	if !ok {
-		routingTable.Data[nodeName] = podSubnet
-		_, err := clientset.CoreV1().ConfigMaps("game").Update(context.Background(), routingTable, metav1.UpdateOptions{})
+	for _, source := range rc.BlockSources {
+		extraBlocks, err := source.NodeBlocks()
 		if err != nil {
-			log.Errorf("unable to update configmap [%s] with [%s] node info", routingTableConfigMapName, nodeName)
 			return err
 		}
-		log.Infof("Configmap [%s] updated with node [%s]", routingTableConfigMapName, nodeName)
+		for node, blocks := range extraBlocks {
+			blocksByNode[node] = append(blocksByNode[node], blocks...)
+		}
+	}
+
+	return rc.syncRoutes(blocksByNode)
+}
+
+// claimBlock records the first block of the pool no node owns yet along with the ranges of the node
+func (rc *RouteController) claimBlock(ranges []*net.IPNet) (*net.IPNet, error) {
+	var block *net.IPNet
+	err := rc.updateRoutingTable(func(data map[string]string) error {
+		owned := []*net.IPNet{}
+		for node, cidrs := range data {
+			if node == rc.NodeName {
+				continue
+			}
+			blocks, err := parseBlocks(cidrs)
+			if err != nil {
+				return fmt.Errorf("invalid blocks of node [%s]: %w", node, err)
+			}
+			owned = append(owned, blocks...)
+		}
+		owned = append(owned, ranges...)
+
+		block = nextFreeBlock(rc.Pool, rc.BlockSize, owned)
+		if block == nil {
+			return fmt.Errorf("no free [/%d] block left in cluster pool [%s]", rc.BlockSize, rc.Pool)
+		}
+
+		data[rc.NodeName] = formatBlocks(append(append([]*net.IPNet{}, ranges...), block))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rc.Log.Infof("Claimed block [%s] for node [%s]", block, rc.NodeName)
+	return block, nil
+}
+
+// publishRanges makes the entry of the node match its ranges, drops the entries of deleted nodes and returns
+// the whole routing table
+func (rc *RouteController) publishRanges(ranges []*net.IPNet) (map[string]string, error) {
+	var routingTable map[string]string
+	err := rc.updateRoutingTable(func(data map[string]string) error {
+		if len(ranges) == 0 {
+			delete(data, rc.NodeName)
+		} else {
+			data[rc.NodeName] = formatBlocks(ranges)
+		}
+
+		for node, cidrs := range data {
+			if node != rc.NodeName && rc.isNodeDeleted(node) {
+				rc.Log.Infof("Reclaiming blocks [%s] of deleted node [%s]", cidrs, node)
+				delete(data, node)
+			}
+		}
+
+		routingTable = data
+		return nil
+	})
+
+	return routingTable, err
+}
+
+// isNodeDeleted double checks with the API server a node the informer does not know, which may only lag behind
+func (rc *RouteController) isNodeDeleted(nodeName string) bool {
+	_, err := rc.Nodes.Get(nodeName)
+	if !errors.IsNotFound(err) {
+		return false
+	}
+
+	_, err = rc.Clientset.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+	return errors.IsNotFound(err)
+}
+
+// updateRoutingTable applies mutate to the ConfigMap, creating it if needed and retrying on conflicts
+func (rc *RouteController) updateRoutingTable(mutate func(data map[string]string) error) error {
+	configMaps := rc.Clientset.CoreV1().ConfigMaps(routingTableNamespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		routingTable, err := configMaps.Get(context.Background(), routingTableConfigMapName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			routingTable, err = configMaps.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      routingTableConfigMapName,
+					Namespace: routingTableNamespace,
+				},
+			}, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				// Another node got there first, its copy is fetched on the retry
+				return errors.NewConflict(corev1.Resource("configmaps"), routingTableConfigMapName, err)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if routingTable.Data == nil {
+			routingTable.Data = map[string]string{}
+		}
+		before := map[string]string{}
+		for node, cidrs := range routingTable.Data {
+			before[node] = cidrs
+		}
+
+		err = mutate(routingTable.Data)
+		if err != nil {
+			return err
+		}
+
+		if reflect.DeepEqual(before, routingTable.Data) {
+			return nil
+		}
+
+		_, err = configMaps.Update(context.Background(), routingTable, metav1.UpdateOptions{})
+		if err == nil {
+			rc.Log.Infof("Configmap [%s] updated with node [%s]: [%s]", routingTableConfigMapName, rc.NodeName, routingTable.Data[rc.NodeName])
+		}
+		return err
+	})
+}
+
+// syncRoutes routes the blocks of the peers through their InternalIP and the blocks of the node the bridge
+// has no address in to the bridge, then drops the routes of blocks nobody owns anymore
+func (rc *RouteController) syncRoutes(blocksByNode map[string][]*net.IPNet) error {
+	desired := []*netlink.Route{}
+
+	for node, blocks := range blocksByNode {
+		if node == rc.NodeName {
+			continue
+		}
+
+		nodeIp, err := rc.nodeInternalIp(node)
+		if err != nil {
+			rc.Log.Warnf("unable to route the blocks of node [%s]: %s", node, err)
+			continue
+		}
+
+		for _, block := range blocks {
+			desired = append(desired, &netlink.Route{
+				Dst:      block,
+				Gw:       nodeIp,
+				Protocol: routeProtocol,
+			})
+		}
+	}
+
+	// The block of the gateway is on the bridge through its address, the others need a route of their own.
+	// Without a bridge (yet) no pod lives in them.
+	bridge, err := netlink.LinkByName(rc.BridgeName)
+	if err == nil {
+		addresses, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+
+		for _, block := range blocksByNode[rc.NodeName] {
+			if onLink(block, addresses) {
+				continue
+			}
+			desired = append(desired, &netlink.Route{
+				LinkIndex: bridge.Attrs().Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       block,
+				Protocol:  routeProtocol,
+			})
+		}
+	}
+
+	for _, route := range desired {
+		err := netlink.RouteReplace(route)
+		if err != nil {
+			rc.Log.Warnf("unable to add route [%s]: %s", route.Dst, err)
+		}
+	}
+
+	current, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Protocol: routeProtocol}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range current {
+		if isDesired(route, desired) {
+			continue
+		}
+
+		err := netlink.RouteDel(&route)
+		if err != nil {
+			rc.Log.Warnf("unable to delete stale route [%s]: %s", route.Dst, err)
+			continue
+		}
+		rc.Log.Infof("Deleted stale route [%s]", route.Dst)
 	}
 
 	return nil
 }
+
+func (rc *RouteController) nodeInternalIp(nodeName string) (net.IP, error) {
+	node, err := rc.Nodes.Get(nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP {
+			ip := net.ParseIP(address.Address)
+			if ip != nil && ip.To4() != nil {
+				return ip, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("node [%s] has no ipv4 InternalIP", nodeName)
+}
+
+// onLink tells whether one of the addresses already covers the block with its connected route
+func onLink(block *net.IPNet, addresses []netlink.Addr) bool {
+	blockSize, _ := block.Mask.Size()
+	for _, address := range addresses {
+		addressSize, _ := address.Mask.Size()
+		if address.IPNet.Contains(block.IP) && addressSize <= blockSize {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isDesired(route netlink.Route, desired []*netlink.Route) bool {
+	for _, wanted := range desired {
+		if route.Dst != nil && route.Dst.String() == wanted.Dst.String() && route.Gw.Equal(wanted.Gw) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextFreeBlock walks the pool block by block and returns the first one overlapping none of owned
+func nextFreeBlock(pool *net.IPNet, blockSize int, owned []*net.IPNet) *net.IPNet {
+	ones, bits := pool.Mask.Size()
+	mask := net.CIDRMask(blockSize, bits)
+	base := ipToUint32(pool.IP.To4())
+
+	for i := uint32(0); i < 1<<uint(blockSize-ones); i++ {
+		block := &net.IPNet{
+			IP:   uint32ToIp(base + i<<uint(bits-blockSize)),
+			Mask: mask,
+		}
+
+		overlaps := false
+		for _, other := range owned {
+			if other.Contains(block.IP) || block.Contains(other.IP) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			return block
+		}
+	}
+
+	return nil
+}
+
+func parseBlocks(cidrs string) ([]*net.IPNet, error) {
+	blocks := []*net.IPNet{}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+func formatBlocks(blocks []*net.IPNet) string {
+	cidrs := []string{}
+	for _, block := range blocks {
+		cidrs = append(cidrs, block.String())
+	}
+
+	return strings.Join(cidrs, ",")
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func uint32ToIp(value uint32) net.IP {
+	return net.IPv4(byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
@@ -0,0 +1,183 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func mustParseCidrs(t *testing.T, cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func TestNextFreeBlock(t *testing.T) {
+	pool := mustParseCidrs(t, "10.244.0.0/24")[0]
+	for _, test := range []struct {
+		name      string
+		blockSize int
+		owned     []string
+		expected  string
+	}{
+		{name: "empty pool", blockSize: 26, owned: nil, expected: "10.244.0.0/26"},
+		{name: "first blocks owned", blockSize: 26, owned: []string{"10.244.0.0/26", "10.244.0.64/26"}, expected: "10.244.0.128/26"},
+		{name: "hole", blockSize: 26, owned: []string{"10.244.0.0/26", "10.244.0.128/26"}, expected: "10.244.0.64/26"},
+		{name: "smaller block owned", blockSize: 26, owned: []string{"10.244.0.8/29"}, expected: "10.244.0.64/26"},
+		{name: "larger block owned", blockSize: 26, owned: []string{"10.244.0.0/25"}, expected: "10.244.0.128/26"},
+		{name: "full pool", blockSize: 25, owned: []string{"10.244.0.0/25", "10.244.0.128/25"}, expected: "<nil>"},
+		{name: "block as large as the pool", blockSize: 24, owned: nil, expected: "10.244.0.0/24"},
+	} {
+		block := nextFreeBlock(pool, test.blockSize, mustParseCidrs(t, test.owned...))
+		if fmt.Sprint(block) != test.expected {
+			t.Errorf("%s: expected [%s], got [%s]", test.name, test.expected, block)
+		}
+	}
+}
+
+func TestParseBlocks(t *testing.T) {
+	for _, test := range []struct {
+		cidrs    string
+		expected string
+		err      bool
+	}{
+		{cidrs: "", expected: "[]"},
+		{cidrs: "10.244.0.0/26", expected: "[10.244.0.0/26]"},
+		{cidrs: " 10.244.0.0/26 , 10.244.1.64/26,", expected: "[10.244.0.0/26 10.244.1.64/26]"},
+		{cidrs: "10.244.0.1/26", expected: "[10.244.0.0/26]"},
+		{cidrs: "10.244.0.0/26,nope", err: true},
+	} {
+		blocks, err := parseBlocks(test.cidrs)
+		if test.err {
+			if err == nil {
+				t.Errorf("[%s]: expected an error", test.cidrs)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(blocks) != test.expected {
+			t.Errorf("[%s]: expected %s, got %v (%v)", test.cidrs, test.expected, blocks, err)
+		}
+	}
+
+	if formatBlocks(mustParseCidrs(t, "10.244.0.0/26", "10.244.1.64/26")) != "10.244.0.0/26,10.244.1.64/26" {
+		t.Error("expected formatBlocks to be the reverse of parseBlocks")
+	}
+}
+
+// newTestRouteController knows the nodes of the informer, the API server knows those and the apiOnly ones
+func newTestRouteController(t *testing.T, routingTable map[string]string, informerNodes []string, apiOnlyNodes []string) *RouteController {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: routingTableConfigMapName, Namespace: routingTableNamespace},
+		Data:       routingTable,
+	})
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range append(append([]string{}, informerNodes...), apiOnlyNodes...) {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		_, err := clientset.CoreV1().Nodes().Create(context.Background(), node, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range informerNodes {
+		err := indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &RouteController{
+		NodeName:  "node-a",
+		Clientset: clientset,
+		Nodes:     corelisters.NewNodeLister(indexer),
+		Pool:      mustParseCidrs(t, "10.244.0.0/24")[0],
+		BlockSize: 26,
+		Log:       logger,
+	}
+}
+
+func TestPublishRangesReclaimsBlocksOfDeletedNodes(t *testing.T) {
+	rc := newTestRouteController(t, map[string]string{
+		"node-a":    "10.244.0.0/26",
+		"node-b":    "10.244.0.64/26",
+		"node-gone": "10.244.0.128/26",
+		"node-new":  "10.244.0.192/26",
+	}, []string{"node-a", "node-b"}, []string{"node-new"})
+
+	routingTable, err := rc.publishRanges(mustParseCidrs(t, "10.244.0.0/26"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// node-new is only missing from the informer so far, it keeps its block
+	expected := map[string]string{
+		"node-a":   "10.244.0.0/26",
+		"node-b":   "10.244.0.64/26",
+		"node-new": "10.244.0.192/26",
+	}
+	if !reflect.DeepEqual(routingTable, expected) {
+		t.Fatalf("expected %v, got %v", expected, routingTable)
+	}
+
+	configMap, err := rc.Clientset.CoreV1().ConfigMaps(routingTableNamespace).Get(context.Background(), routingTableConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(configMap.Data, expected) {
+		t.Fatalf("expected the ConfigMap to be updated, got %v", configMap.Data)
+	}
+
+	// The reclaimed block is the next one handed out
+	block, err := rc.claimBlock(mustParseCidrs(t, "10.244.0.0/26"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.String() != "10.244.0.128/26" {
+		t.Fatalf("expected the block of the deleted node, got [%s]", block)
+	}
+}
+
+func TestNodeInternalIpFromLister(t *testing.T) {
+	rc := newTestRouteController(t, map[string]string{}, nil, nil)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err := indexer.Add(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-b"},
+		Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+			{Type: corev1.NodeHostName, Address: "node-b"},
+			{Type: corev1.NodeInternalIP, Address: "fd00::2"},
+			{Type: corev1.NodeInternalIP, Address: "10.0.0.2"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Nodes = corelisters.NewNodeLister(indexer)
+
+	ip, err := rc.nodeInternalIp("node-b")
+	if err != nil || ip.String() != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2, got %s (%v)", ip, err)
+	}
+
+	_, err = rc.nodeInternalIp("node-c")
+	if err == nil {
+		t.Fatal("expected an error for an unknown node")
+	}
+}
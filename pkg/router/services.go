@@ -0,0 +1,211 @@
+package router
+
+import (
+	"fmt"
+	"time"
+	"yarp-cni/pkg/nft"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// syncKey is the only item of the queue: any change re-renders the whole services table
+const syncKey = "services"
+
+const resyncPeriod = 10 * time.Minute
+
+// ServiceProxy load balances ClusterIPs and NodePorts to the ready endpoints of the Services, in place of kube-proxy
+type ServiceProxy struct {
+	NodeName       string
+	Services       corelisters.ServiceLister
+	EndpointSlices discoverylisters.EndpointSliceLister
+	Queue          workqueue.RateLimitingInterface
+	Log            *logrus.Logger
+
+	factory informers.SharedInformerFactory
+}
+
+func NewServiceProxy(log *logrus.Logger, clientset kubernetes.Interface, nodeName string) *ServiceProxy {
+	factory := informers.NewSharedInformerFactory(clientset, resyncPeriod)
+	serviceInformer := factory.Core().V1().Services()
+	endpointSliceInformer := factory.Discovery().V1().EndpointSlices()
+
+	proxy := &ServiceProxy{
+		NodeName:       nodeName,
+		Services:       serviceInformer.Lister(),
+		EndpointSlices: endpointSliceInformer.Lister(),
+		Queue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "yarp-services"),
+		Log:            log,
+		factory:        factory,
+	}
+
+	enqueue := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { proxy.Queue.Add(syncKey) },
+		UpdateFunc: func(oldObj, newObj interface{}) { proxy.Queue.Add(syncKey) },
+		DeleteFunc: func(obj interface{}) { proxy.Queue.Add(syncKey) },
+	}
+	serviceInformer.Informer().AddEventHandler(enqueue)
+	endpointSliceInformer.Informer().AddEventHandler(enqueue)
+
+	return proxy
+}
+
+// Run programs the services table until stopCh is closed
+func (proxy *ServiceProxy) Run(stopCh <-chan struct{}) error {
+	proxy.factory.Start(stopCh)
+	for informer, synced := range proxy.factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			return fmt.Errorf("unable to sync informer [%s]", informer)
+		}
+	}
+
+	proxy.Log.Infof("Service proxy started on node [%s]", proxy.NodeName)
+	proxy.Queue.Add(syncKey)
+	go func() {
+		<-stopCh
+		proxy.Queue.ShutDown()
+	}()
+
+	for proxy.processNextItem() {
+	}
+
+	return nil
+}
+
+func (proxy *ServiceProxy) processNextItem() bool {
+	key, shutdown := proxy.Queue.Get()
+	if shutdown {
+		return false
+	}
+	defer proxy.Queue.Done(key)
+
+	err := proxy.sync()
+	if err != nil {
+		proxy.Log.Errorf("unable to sync services: %s", err)
+		proxy.Queue.AddRateLimited(key)
+		return true
+	}
+
+	proxy.Queue.Forget(key)
+	return true
+}
+
+func (proxy *ServiceProxy) sync() error {
+	services, err := proxy.desiredServices()
+	if err != nil {
+		return err
+	}
+
+	chains, err := nft.RenderServices(services)
+	if err != nil {
+		return err
+	}
+
+	err = nft.Apply(nft.ServicesTableName, chains)
+	if err != nil {
+		return err
+	}
+
+	proxy.Log.Debugf("Programmed [%d] service ports", len(services))
+	return nil
+}
+
+// desiredServices flattens the ClusterIP and NodePort services into one entry per port
+func (proxy *ServiceProxy) desiredServices() ([]*nft.Service, error) {
+	services, err := proxy.Services.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	desired := []*nft.Service{}
+	for _, service := range services {
+		if service.Spec.Type != corev1.ServiceTypeClusterIP && service.Spec.Type != corev1.ServiceTypeNodePort && service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		// Headless services are resolved by DNS, there is nothing to load balance
+		if service.Spec.ClusterIP == "" || service.Spec.ClusterIP == corev1.ClusterIPNone {
+			continue
+		}
+
+		slices, err := proxy.EndpointSlices.EndpointSlices(service.Namespace).List(labels.SelectorFromSet(labels.Set{
+			discoveryv1.LabelServiceName: service.Name,
+		}))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, port := range service.Spec.Ports {
+			entry := &nft.Service{
+				Name:      fmt.Sprintf("%s/%s:%s", service.Namespace, service.Name, port.Name),
+				ClusterIp: service.Spec.ClusterIP,
+				Port:      int(port.Port),
+				NodePort:  int(port.NodePort),
+				Protocol:  string(port.Protocol),
+				Endpoints: []nft.ServiceEndpoint{},
+			}
+
+			local := []nft.ServiceEndpoint{}
+			for _, slice := range slices {
+				if slice.AddressType != discoveryv1.AddressTypeIPv4 {
+					continue
+				}
+
+				targetPort, ok := slicePort(slice, port)
+				if !ok {
+					continue
+				}
+
+				for _, endpoint := range slice.Endpoints {
+					// A nil ready condition is to be read as ready
+					if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+						continue
+					}
+
+					for _, address := range endpoint.Addresses {
+						serviceEndpoint := nft.ServiceEndpoint{Ip: address, Port: targetPort}
+						entry.Endpoints = append(entry.Endpoints, serviceEndpoint)
+						if endpoint.NodeName != nil && *endpoint.NodeName == proxy.NodeName {
+							local = append(local, serviceEndpoint)
+						}
+					}
+				}
+			}
+
+			if service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+				entry.NodePortEndpoints = local
+			}
+
+			desired = append(desired, entry)
+		}
+	}
+
+	return desired, nil
+}
+
+// slicePort finds the port of the slice matching the service port, slice ports being named after service ports
+func slicePort(slice *discoveryv1.EndpointSlice, servicePort corev1.ServicePort) (int, bool) {
+	for _, port := range slice.Ports {
+		name := ""
+		if port.Name != nil {
+			name = *port.Name
+		}
+		protocol := corev1.ProtocolTCP
+		if port.Protocol != nil {
+			protocol = *port.Protocol
+		}
+
+		if name == servicePort.Name && protocol == servicePort.Protocol && port.Port != nil {
+			return int(*port.Port), true
+		}
+	}
+
+	return 0, false
+}
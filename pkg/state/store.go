@@ -0,0 +1,82 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Attachment records what an ADD set up for one interface of a pod, so that DEL can undo exactly that
+type Attachment struct {
+	ContainerId   string   `json:"containerId"`
+	InterfaceName string   `json:"interfaceName"`
+	Network       string   `json:"network"`
+	HostInterface string   `json:"hostInterface,omitempty"`
+	Ips           []string `json:"ips"`
+}
+
+// Store keeps one file per attachment in Dir
+type Store struct {
+	Dir string
+}
+
+func NewStore(dir string) *Store {
+	return &Store{
+		Dir: dir,
+	}
+}
+
+func (store *Store) Save(attachment *Attachment) error {
+	err := os.MkdirAll(store.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(attachment)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash never leaves a truncated file behind
+	path := store.path(attachment.ContainerId, attachment.InterfaceName)
+	err = ioutil.WriteFile(path+".tmp", content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// Load returns nil, without error, when nothing was recorded for the attachment
+func (store *Store) Load(containerId string, interfaceName string) (*Attachment, error) {
+	content, err := ioutil.ReadFile(store.path(containerId, interfaceName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	attachment := &Attachment{}
+	err = json.Unmarshal(content, attachment)
+	if err != nil {
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+func (store *Store) Delete(containerId string, interfaceName string) error {
+	err := os.Remove(store.path(containerId, interfaceName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (store *Store) path(containerId string, interfaceName string) string {
+	return filepath.Join(store.Dir, fmt.Sprintf("%s-%s.json", containerId, interfaceName))
+}
@@ -0,0 +1,56 @@
+package sysctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const sysctlBase = "/proc/sys"
+
+// Get reads a sysctl given in dotted (net.ipv4.ip_forward) or slashed (net/ipv4/ip_forward) notation
+func Get(name string) (string, error) {
+	path, err := sysctlPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Set writes a sysctl given in dotted (net.ipv4.ip_forward) or slashed (net/ipv4/ip_forward) notation.
+// Network sysctls apply to the network namespace of the calling thread.
+func Set(name string, value string) error {
+	path, err := sysctlPath(name)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
+
+// sysctlPath only translates dots when no slash is present, so interface names holding dots (eth0.100) can be addressed.
+// Names that would resolve outside of /proc/sys, or to /proc/sys itself, are refused.
+func sysctlPath(name string) (string, error) {
+	if !strings.Contains(name, "/") {
+		name = strings.ReplaceAll(name, ".", "/")
+	}
+
+	path := filepath.Join(sysctlBase, name)
+	if !strings.HasPrefix(path, sysctlBase+"/") {
+		return "", fmt.Errorf("invalid sysctl [%s]", name)
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "", fmt.Errorf("invalid sysctl [%s]", name)
+		}
+	}
+
+	return path, nil
+}
@@ -0,0 +1,38 @@
+package sysctl
+
+import "testing"
+
+func TestSysctlPath(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{name: "net.ipv4.ip_forward", expected: "/proc/sys/net/ipv4/ip_forward"},
+		{name: "net/ipv4/ip_forward", expected: "/proc/sys/net/ipv4/ip_forward"},
+		{name: "net.ipv4.conf.eth0.rp_filter", expected: "/proc/sys/net/ipv4/conf/eth0/rp_filter"},
+		{name: "net/ipv4/conf/eth0.100/rp_filter", expected: "/proc/sys/net/ipv4/conf/eth0.100/rp_filter"},
+		{name: "net.bridge.bridge-nf-call-iptables", expected: "/proc/sys/net/bridge/bridge-nf-call-iptables"},
+		{name: ""},
+		{name: "."},
+		{name: "net/../../../etc/passwd"},
+		{name: "net/ipv4/conf/../ip_forward"},
+	} {
+		path, err := sysctlPath(test.name)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected the name to be refused, got [%s]", test.name, path)
+			}
+			continue
+		}
+		if err != nil || path != test.expected {
+			t.Errorf("%s: expected [%s], got [%s] (%v)", test.name, test.expected, path, err)
+		}
+	}
+}
+
+func TestSetUnknownSysctl(t *testing.T) {
+	err := Set("net.ipv4.yarp_unknown_sysctl", "1")
+	if err == nil {
+		t.Fatal("expected an unknown sysctl to be refused")
+	}
+}